@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The answer to a user without access: with the "Request access" button, if a request can be sent
+func accessDeniedMessage(chatID int64, u *BotUser) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(chatID, t("Access denied."))
+
+	usersMutex.Lock()
+	role, requested := u.Role, u.AccessRequested
+	usersMutex.Unlock()
+
+	switch {
+	case role == roleBanned:
+	case requested:
+		msg.Text = t("Access denied. Your request is waiting for the decision of an administrator.")
+	default:
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(t("🔑 Request access"), callbackData("access", "request")),
+		))
+	}
+	return msg
+}
+
+// Buttons of the access request: "request" by the user, "approve:<id>" and "deny:<id>" by administrators
+func handleAccessCallback(query *tgbotapi.CallbackQuery, data string) string {
+	decision, arg, _ := strings.Cut(data, ":")
+	if decision == "request" {
+		return requestAccess(query)
+	}
+
+	if !isAdmin(query.From.ID) {
+		return t("This action is available only to administrators.")
+	}
+
+	userID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || (decision != "approve" && decision != "deny") {
+		return t("Unknown action.")
+	}
+	return decideAccess(query, userID, decision == "approve")
+}
+
+// Sending the access request of the user to all administrators
+func requestAccess(query *tgbotapi.CallbackQuery) string {
+	usersMutex.Lock()
+	u, ok := users[query.From.ID]
+	if !ok {
+		usersMutex.Unlock()
+		return t("Unknown action.")
+	}
+	role, requested := u.Role, u.AccessRequested
+	if role != roleBanned && !requested && !limitsForRole(role).Access {
+		u.AccessRequested = true
+	}
+	username := u.Username
+	usersMutex.Unlock()
+
+	switch {
+	case role == roleBanned:
+		return t("Access denied.")
+	case limitsForRole(role).Access:
+		return t("You already have access.")
+	case requested:
+		return t("Your request has already been sent.")
+	}
+
+	if err := saveUsers(); err != nil {
+		logger.Errorf("Error saving users: %v", err)
+	}
+
+	text := t("User %s (ID %d) requests access to the bot.", displayName(username, query.From.ID), query.From.ID)
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(t("✅ Approve"), callbackData("access", fmt.Sprintf("approve:%d", query.From.ID))),
+		tgbotapi.NewInlineKeyboardButtonData(t("❌ Deny"), callbackData("access", fmt.Sprintf("deny:%d", query.From.ID))),
+	))
+
+	notified := 0
+	for _, admin := range getSortedUsers() {
+		if admin.Role != roleAdmin {
+			continue
+		}
+		// The private chat with the administrator has the ID of the administrator
+		msg := tgbotapi.NewMessage(admin.ID, text)
+		msg.ReplyMarkup = keyboard
+		if _, err := bot.Send(msg); err != nil {
+			logger.Errorf("Error notifying administrator %d: %v", admin.ID, err)
+			continue
+		}
+		notified++
+	}
+
+	logger.Infof("User %d requested access, administrators notified: %d", query.From.ID, notified)
+	if notified == 0 {
+		logger.Warn("No administrator could be notified about the access request")
+	}
+
+	// The button is not needed anymore
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, t("Your access request has been sent to the administrators."))
+	_, _ = bot.Request(edit)
+	return t("The request has been sent.")
+}
+
+// The decision of the administrator on the access request
+func decideAccess(query *tgbotapi.CallbackQuery, userID int64, approve bool) string {
+	usersMutex.Lock()
+	u, ok := users[userID]
+	pending := ok && u.AccessRequested
+	if pending {
+		u.AccessRequested = false
+		if approve {
+			u.Role = roleUser
+		}
+	}
+	var username string
+	if ok {
+		username = u.Username
+	}
+	usersMutex.Unlock()
+
+	// Another administrator could have decided already
+	if !pending {
+		return t("The request has already been processed.")
+	}
+
+	if err := saveUsers(); err != nil {
+		logger.Errorf("Error saving users: %v", err)
+	}
+
+	admin := displayName(query.From.UserName, query.From.ID)
+	name := displayName(username, userID)
+	var status, notice string
+	if approve {
+		status = t("✅ Access for %s (ID %d) approved by %s.", name, userID, admin)
+		notice = t("Your access request has been approved. You can use the bot now.")
+	} else {
+		status = t("❌ Access for %s (ID %d) denied by %s.", name, userID, admin)
+		notice = t("Your access request has been denied.")
+	}
+	logger.Infof("Administrator %d decided on the access of the user %d: approved=%t", query.From.ID, userID, approve)
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, status)
+	_, _ = bot.Request(edit)
+
+	// The private chat with the user has the ID of the user
+	if _, err := bot.Send(tgbotapi.NewMessage(userID, notice)); err != nil {
+		logger.Errorf("Error notifying user %d: %v", userID, err)
+	}
+
+	if approve {
+		return t("Approved.")
+	}
+	return t("Denied.")
+}
+
+// The name of the user for messages: the name or, if it is unknown, the ID
+func displayName(username string, userID int64) string {
+	if username == "" {
+		return strconv.FormatInt(userID, 10)
+	}
+	return username
+}
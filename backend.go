@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	backendOpenAI = "openai" // LM Studio and other servers with the OpenAI-compatible API
+	backendOllama = "ollama" // Native API of Ollama
+)
+
+// BackendConfig A server with models from the configuration
+type BackendConfig struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // "openai" or "ollama"
+	Address string `json:"address"`
+	// Several hosts with the same models: the requests are balanced between them
+	Addresses []string `json:"addresses,omitempty"`
+	APIKey    string   `json:"api_key,omitempty"`
+}
+
+// ChatRequest A request for the answer of the model
+type ChatRequest struct {
+	Model    string // The name of the model on the server (without the name of the backend)
+	Messages []LMMessage
+	Tools    []LMTool
+	Params   SamplingParams
+}
+
+// Backend A server that runs the models
+type Backend interface {
+	// The name of the backend from the configuration
+	Name() string
+	// Models available on the server
+	Models(ctx context.Context) ([]string, error)
+	// The full answer of the model
+	Chat(ctx context.Context, req ChatRequest) (LMMessage, LMUsage, error)
+	// The answer in parts: onStart (if set) is called when the answer begins, onText receives the text received so far.
+	// On an error the partial message is returned with it.
+	ChatStream(ctx context.Context, req ChatRequest, onStart func() error, onText func(text string)) (LMMessage, LMUsage, error)
+	// Vectors of the texts (not normalized)
+	Embeddings(ctx context.Context, model string, inputs []string) ([][]float32, error)
+}
+
+// The backends of the configuration; without them the single LM Studio backend at APIAddress is used
+func configuredBackends() []Backend {
+	list := config.Backends
+	if len(list) == 0 {
+		list = []BackendConfig{{Name: "lmstudio", Type: backendOpenAI, Address: config.APIAddress, Addresses: config.APIAddresses}}
+	}
+
+	var result []Backend
+	for _, c := range list {
+		pool := hostPool{name: c.Name, addresses: backendAddresses(c.Address, c.Addresses), apiKey: c.APIKey}
+		switch c.Type {
+		case backendOpenAI, "":
+			result = append(result, &openAIBackend{hostPool: pool})
+		case backendOllama:
+			result = append(result, &ollamaBackend{hostPool: pool})
+		default:
+			logger.Warnf("Unknown type of the backend %s: %s", c.Name, c.Type)
+		}
+	}
+	return result
+}
+
+// The name of the model shown to users: with several backends it is prefixed by the name of the backend
+func qualifiedModel(backend Backend, model string, backends []Backend) string {
+	if len(backends) < 2 {
+		return model
+	}
+	return backend.Name() + "/" + model
+}
+
+// The backend and the name of the model on it by the name shown to users.
+// A name without a known backend prefix belongs to the first backend
+// (model names of LM Studio can contain "/" themselves).
+func resolveModel(name string) (Backend, string, error) {
+	backends := configuredBackends()
+	if len(backends) == 0 {
+		return nil, "", errors.New("no backends are configured")
+	}
+
+	if len(backends) > 1 {
+		if prefix, model, ok := strings.Cut(name, "/"); ok {
+			for _, b := range backends {
+				if b.Name() == prefix {
+					return b, model, nil
+				}
+			}
+		}
+	}
+	return backends[0], name, nil
+}
+
+// Getting the list of models of all backends (unavailable backends are skipped)
+func fetchModels(ctx context.Context) ([]string, error) {
+	backends := configuredBackends()
+
+	var models []string
+	var lastErr error
+	available := 0
+	for _, b := range backends {
+		list, err := b.Models(ctx)
+		if err != nil {
+			logger.Errorf("Error getting models of the backend %s: %v", b.Name(), err)
+			lastErr = err
+			continue
+		}
+		available++
+		for _, m := range list {
+			models = append(models, qualifiedModel(b, m, backends))
+		}
+	}
+
+	if available == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return models, nil
+}
+
+// Sending a JSON request to a backend; the response with a status other than 200 is an error
+func doJSONRequest(ctx context.Context, method, url, apiKey string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	client := &http.Client{Timeout: apiTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		closeBody(resp.Body)
+		return nil, &statusError{code: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// statusError The server answered with a status other than 200
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("invalid status code: %d", e.code)
+}
+
+// Closing the body of a response
+func closeBody(body io.ReadCloser) {
+	if err := body.Close(); err != nil {
+		logger.Errorf("Error closing response: %v", err)
+	}
+}
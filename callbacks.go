@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CallbackHandler Handler of pressing an inline button. Receives the data after the action name
+// ("model:3" -> "3") and returns the text of the notification for the user (may be empty)
+type CallbackHandler func(query *tgbotapi.CallbackQuery, data string) string
+
+// Handlers by the action name, the callback data has the format "<action>:<data>"
+var callbackHandlers = make(map[string]CallbackHandler)
+
+func init() {
+	registerCallbackHandler("model", handleModelCallback)
+	registerCallbackHandler("regen", handleRegenerateCallback)
+	registerCallbackHandler("cont", handleContinueCallback)
+	registerCallbackHandler("clear", handleClearCallback)
+	registerCallbackHandler("alt", handleAlternativeCallback)
+	registerCallbackHandler("stop", handleStopCallback)
+	registerCallbackHandler("doc", handleDocumentCallback)
+	registerCallbackHandler("access", handleAccessCallback)
+}
+
+// Registration of the handler of the action
+func registerCallbackHandler(action string, handler CallbackHandler) {
+	callbackHandlers[action] = handler
+}
+
+// Callback data for the action of the button
+func callbackData(action, data string) string {
+	if data == "" {
+		return action
+	}
+	return action + ":" + data
+}
+
+// Processing of pressing the inline keyboard buttons
+func handleCallbackQuery(query *tgbotapi.CallbackQuery) {
+	user := query.From
+	username := user.UserName
+	if username == "" {
+		username = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+
+	botUser := addOrUpdateUser(user.ID, username)
+
+	action, data, _ := strings.Cut(query.Data, ":")
+	handler, ok := callbackHandlers[action]
+
+	var answer string
+	switch {
+	case query.Message != nil && isGroupChat(query.Message.Chat) && !isGroupAllowed(query.Message.Chat.ID):
+		answer = t("The bot is not available in this chat.")
+	// Users without access can only request it
+	case !hasAccess(botUser) && action != "access":
+		answer = t("Access denied.")
+	case !ok || query.Message == nil:
+		logger.Warnf("Unknown callback query: %s", query.Data)
+		answer = t("Unknown action.")
+	default:
+		answer = handler(query, data)
+	}
+
+	if _, err := bot.Request(tgbotapi.NewCallback(query.ID, answer)); err != nil {
+		logger.Errorf("Error answering callback query: %v", err)
+	}
+}
+
+// The "Continue" button: the model is asked to continue the answer
+func handleContinueCallback(query *tgbotapi.CallbackQuery, _ string) string {
+	key := messageConversation(query.Message)
+	userID := query.From.ID
+	if denial := admitGeneration(userID); denial != "" {
+		return denial
+	}
+	return enqueueGeneration(key, userID, func() {
+		appendToConversation(key, userID, "user", t("Continue."))
+		replyToPrompt(key, userID)
+	})
+}
+
+// The "Clear context" button
+func handleClearCallback(query *tgbotapi.CallbackQuery, _ string) string {
+	key := messageConversation(query.Message)
+	clearConversationContext(key)
+	forgetLastReply(key)
+	removeKeyboard(key.ChatID, query.Message.MessageID)
+	return t("Chat history cleared.")
+}
+
+// Removing the buttons from the message
+func removeKeyboard(chatID int64, messageID int) {
+	empty := tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}
+	edit := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, empty)
+	if _, err := bot.Request(edit); err != nil {
+		logger.Debugf("Error removing keyboard: %v", err)
+	}
+}
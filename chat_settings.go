@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// ChatSettings Settings of a chat chosen by its users
+type ChatSettings struct {
+	ChatID int64  `json:"chat_id"`
+	Model  string `json:"model,omitempty"`
+
+	// Generation parameters of the chat (/settings), override the parameters of the configuration
+	SamplingParams
+}
+
+var (
+	chatSettings         = make(map[int64]*ChatSettings)
+	chatSettingsFileName = "chat_settings.json"
+	chatSettingsMutex    sync.Mutex
+)
+
+// Loading chat settings from a file
+func loadChatSettings() error {
+	chatSettingsMutex.Lock()
+	defer chatSettingsMutex.Unlock()
+
+	data, err := os.ReadFile(chatSettingsFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			chatSettings = make(map[int64]*ChatSettings)
+			return nil
+		}
+		return err
+	}
+
+	var list []*ChatSettings
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	chatSettings = make(map[int64]*ChatSettings)
+	for _, s := range list {
+		chatSettings[s.ChatID] = s
+	}
+
+	return nil
+}
+
+// Saving chat settings to a file
+func saveChatSettings() error {
+	chatSettingsMutex.Lock()
+	defer chatSettingsMutex.Unlock()
+
+	var list []*ChatSettings
+	for _, s := range chatSettings {
+		list = append(list, s)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(chatSettingsFileName, data, 0644)
+}
+
+// Changing the settings of the chat and saving them
+func updateChatSettings(chatID int64, update func(s *ChatSettings)) error {
+	chatSettingsMutex.Lock()
+	s, ok := chatSettings[chatID]
+	if !ok {
+		s = &ChatSettings{ChatID: chatID}
+		chatSettings[chatID] = s
+	}
+	update(s)
+	chatSettingsMutex.Unlock()
+
+	return saveChatSettings()
+}
+
+// The model of the chat or the global default model
+func getChatModel(chatID int64) string {
+	chatSettingsMutex.Lock()
+	defer chatSettingsMutex.Unlock()
+
+	if s, ok := chatSettings[chatID]; ok && s.Model != "" {
+		return s.Model
+	}
+	return selectedModel
+}
+
+// Choosing the model of the chat ("" returns the chat to the global default model)
+func setChatModel(chatID int64, model string) error {
+	return updateChatSettings(chatID, func(s *ChatSettings) {
+		s.Model = model
+	})
+}
@@ -9,8 +9,8 @@ import (
 // Config The structure of the configuration
 type Config struct {
 	// General parameters
-	APIAddress     string `json:"api_address"`
-	TokenLimit     int    `json:"token_limit"`
+	APIAddress     string `json:"api_address"` // Address of LM Studio, if no backends are configured
+	TokenLimit     int    `json:"token_limit"` // Budget of the context in tokens (the length of the answer is max_tokens)
 	SystemRole     string `json:"system_role"`
 	PollingTimeout int    `json:"polling_timeout"`
 	BotToken       string `json:"bot_token"`
@@ -29,6 +29,84 @@ type Config struct {
 	// "full" – Waiting for a ready answer.
 	LMStudioMode string `json:"lm_studio_mode"`
 
+	// Edits of the message in Streaming-mode: not more often than the interval (ms)
+	// and not less than the number of new characters
+	StreamEditInterval int `json:"stream_edit_interval_ms"`
+	StreamEditMinChars int `json:"stream_edit_min_chars"`
+
+	// Markup of the answers in Telegram: "HTML" or "MarkdownV2" (Markdown of the model is converted)
+	ParseMode string `json:"parse_mode"`
+
+	// Display of the reasoning of the model (<think> blocks): "hide", "expandable", "spoiler" or "message"
+	ReasoningMode string `json:"reasoning_mode"`
+
+	// Answers longer than this number of characters are sent as a .md document (0 - split into messages)
+	DocumentThreshold int `json:"document_threshold"`
+
+	// How many requests are sent to the model at the same time (the rest wait in the queue)
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// How many answers are kept after regeneration to page between them (1 - only the last one)
+	MaxAlternatives int `json:"max_alternatives"`
+
+	// Counting tokens for the context budget: "approx" or "bpe" (tokenizer.json of the model in TokenizerFile)
+	Tokenizer     string `json:"tokenizer"`
+	TokenizerFile string `json:"tokenizer_file"`
+
+	// Storage of dialogue contexts: "memory" or "file" (JSON file per chat in ConversationDir)
+	ConversationStore string `json:"conversation_store"`
+	ConversationDir   string `json:"conversation_dir"`
+
+	// Speech recognition of voice messages: OpenAI-compatible server with /audio/transcriptions
+	// (for example, a local whisper server); if the address is empty, voice messages are not accepted
+	STTAddress  string `json:"stt_address"`
+	STTModel    string `json:"stt_model"`
+	STTLanguage string `json:"stt_language"` // Language of the speech (ISO-639-1), empty - auto detection
+
+	// Knowledge base: Markdown/text files of the folder are indexed with the embedding model,
+	// the KnowledgeTopK closest fragments (with similarity not less than KnowledgeMinScore) are added to requests
+	KnowledgeDir      string  `json:"knowledge_dir"`
+	EmbeddingModel    string  `json:"embedding_model"`
+	KnowledgeTopK     int     `json:"knowledge_top_k"`
+	KnowledgeMinScore float64 `json:"knowledge_min_score"`
+	KnowledgeIndex    string  `json:"knowledge_index"`
+
+	// Tool calling: names of the tools offered to the model (current_time, calculator, list_files, read_file;
+	// none by default, requests with tools do not calibrate the tokenizer),
+	// read_file and list_files work only inside ToolsDir and are disabled if it is empty
+	Tools    []string `json:"tools"`
+	ToolsDir string   `json:"tools_dir"`
+
+	// Servers with models: LM Studio and other OpenAI-compatible servers ("openai") or Ollama ("ollama").
+	// With several backends the models are named "<backend>/<model>"
+	Backends []BackendConfig `json:"backends"`
+	// Several LM Studio hosts instead of APIAddress (for the backend by default)
+	APIAddresses []string `json:"api_addresses"`
+	// Distribution of the requests between the hosts: "round_robin" or "least_busy"
+	LoadBalancing string `json:"load_balancing"`
+	// Interval of the health checks of the hosts via the list of models (seconds), 0 - disabled
+	HealthCheckInterval int `json:"health_check_interval"`
+
+	// Generation parameters of the requests (temperature, top_p, max_tokens, stop, penalties, seed),
+	// unset parameters are not sent; chats can override them with /settings
+	SamplingParams
+
+	// Telegram IDs of the users who always get the role "admin" (the first administrators)
+	Admins []int64 `json:"admins"`
+
+	// Limits of the roles "user" and "guest": access, models, maximum context, uploading of files
+	RoleLimits map[string]RoleLimits `json:"role_limits"`
+
+	// Group chats where the bot works (empty - any group) and where it never works
+	AllowedGroups []int64 `json:"allowed_groups"`
+	DeniedGroups  []int64 `json:"denied_groups"`
+
+	// Model used by default (also selected in the GUI "Models" tab)
+	Model string `json:"model"`
+
+	// Running without GUI (daemon mode), can also be enabled by the -headless flag
+	Headless bool `json:"headless"`
+
 	Language string `json:"language"`
 	LogLevel string `json:"log_level"`
 	LogFile  string `json:"log_file"`
@@ -70,20 +148,34 @@ func saveConfig() error {
 func initConfig() {
 	if _, err := os.Stat(configFileName); os.IsNotExist(err) {
 		config = Config{
-			APIAddress:     "http://localhost:1234",
-			TokenLimit:     2048,
-			SystemRole:     "You are a helpful assistant.",
-			PollingTimeout: 60,
-			BotToken:       "YOUR_TELEGRAM_BOT_TOKEN",
-			UpdateMethod:   "polling",
-			WebhookDomain:  "mybot.domain.com",
-			WebhookPort:    "443",
-			CertFile:       "cert.pem",
-			KeyFile:        "key.pem",
-			LMStudioMode:   "full", // Values: "stream" or "full"
-			Language:       "en",
-			LogLevel:       "debug",
-			LogFile:        "app.log",
+			APIAddress:            "http://localhost:1234",
+			TokenLimit:            2048,
+			SystemRole:            "You are a helpful assistant.",
+			PollingTimeout:        60,
+			BotToken:              "YOUR_TELEGRAM_BOT_TOKEN",
+			UpdateMethod:          "polling",
+			WebhookDomain:         "mybot.domain.com",
+			WebhookPort:           "443",
+			CertFile:              "cert.pem",
+			KeyFile:               "key.pem",
+			LMStudioMode:          "full", // Values: "stream" or "full"
+			ParseMode:             "HTML", // Values: "HTML" or "MarkdownV2"
+			ReasoningMode:         "expandable",
+			MaxConcurrentRequests: 1,
+			MaxAlternatives:       5,
+			Tokenizer:             "approx", // Values: "approx" or "bpe"
+			ConversationStore:     "file",   // Values: "memory" or "file"
+			ConversationDir:       "conversations",
+			STTModel:              "whisper-1",
+			KnowledgeTopK:         4,
+			KnowledgeMinScore:     0.3,
+			KnowledgeIndex:        "knowledge_index.json",
+			RoleLimits:            defaultRoleLimits,
+			LoadBalancing:         balanceRoundRobin,
+			HealthCheckInterval:   30,
+			Language:              "en",
+			LogLevel:              "debug",
+			LogFile:               "app.log",
 		}
 
 		if err := saveConfig(); err != nil {
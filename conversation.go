@@ -1,28 +1,74 @@
 package main
 
 import (
-	"regexp"
-	"strings"
 	"sync"
 )
 
 var (
-	// Dialogue contexts for each chat
-	contexts = make(map[int64][]LMMessage)
+	// Dialogue contexts for each conversation (chat or reply chain of a group)
+	conversations ConversationStore = newMemoryConversationStore()
+	// Serializes reading and changing of contexts
 	ctxMutex = sync.Mutex{}
 )
 
-// Building the history of the request, taking into account the restrictions of tokens
-func buildConversationForRequest(chatID int64) []LMMessage {
+// Initialization of the storage of dialogue contexts by the configuration
+func initConversationStore() error {
+	store, err := newConversationStore()
+	if err != nil {
+		return err
+	}
+	conversations = store
+	return nil
+}
+
+// Loading the chat history; a new history begins with a system message
+func loadConversation(key conversationKey) []LMMessage {
+	msgs, err := conversations.Load(key)
+	if err != nil {
+		logger.Errorf("Error loading conversation %v: %v", key, err)
+	}
+
+	if len(msgs) == 0 {
+		msgs = []LMMessage{
+			{Role: "system", Content: config.SystemRole},
+		}
+	}
+
+	return msgs
+}
+
+// Saving the chat history
+func saveConversation(key conversationKey, msgs []LMMessage) {
+	if err := conversations.Save(key, msgs); err != nil {
+		logger.Errorf("Error saving conversation %v: %v", key, err)
+	}
+}
+
+// Building the history of the request, taking into account the restrictions of tokens.
+// The knowledge (fragments of the knowledge base) is added to the system message,
+// tokenLimit is the budget of the context for the user. The images are given as references
+// of the history (see downloadHistoryImages).
+func buildConversationForRequest(key conversationKey, model, knowledge string, tokenLimit int) []LMMessage {
 	ctxMutex.Lock()
 	defer ctxMutex.Unlock()
 
-	allMsgs := contexts[chatID]
+	allMsgs := withoutOldImages(loadConversation(key))
+
+	// Attached documents take no more than half of the budget, the rest is left for the history
+	budget := tokenLimit
+	documents := documentContext(key, model, lastUserMessage(allMsgs), budget/2)
+	if documents != "" {
+		budget -= estimateTokens(model, LMMessage{Role: "system", Content: documents})
+	}
+	if knowledge != "" {
+		budget -= estimateTokens(model, LMMessage{Role: "system", Content: knowledge})
+	}
+
 	var result []LMMessage
 	tokenCount := 0
 	for i := len(allMsgs) - 1; i >= 0; i-- {
-		msgTokens := len(strings.Fields(allMsgs[i].Content))
-		if tokenCount+msgTokens > config.TokenLimit {
+		msgTokens := estimateTokens(model, allMsgs[i])
+		if tokenCount+msgTokens > budget {
 			break
 		}
 		tokenCount += msgTokens
@@ -34,83 +80,83 @@ func buildConversationForRequest(chatID int64) []LMMessage {
 		result[i], result[j] = result[j], result[i]
 	}
 
-	return result
+	return withSystemContext(withSystemContext(result, documents), knowledge)
 }
 
-// Context updating for the "Full" mode
-func updateConversationContext(chatID int64, role, content string) {
+// Adding a message to the context of the conversation
+func appendToConversation(key conversationKey, userID int64, role, content string) {
+	appendMessageToConversation(key, userID, LMMessage{Role: role, Content: content})
+}
+
+// Adding a message (possibly with images) to the context, the oldest messages are removed
+// by the context limit of the user
+func appendMessageToConversation(key conversationKey, userID int64, msg LMMessage) {
+	model, _ := resolveChatModel(key.ChatID, userID)
+	limit := contextLimit(userID)
+
 	ctxMutex.Lock()
 	defer ctxMutex.Unlock()
 
-	if _, ok := contexts[chatID]; !ok {
-		contexts[chatID] = []LMMessage{
-			{Role: "system", Content: config.SystemRole},
-		}
+	msgs := append(loadConversation(key), msg)
+	saveConversation(key, trimConversation(model, limit, msgs))
+}
+
+// Replacing the text of the last answer of the model (choosing an alternative answer)
+func replaceLastAssistantMessage(key conversationKey, content string) bool {
+	ctxMutex.Lock()
+	defer ctxMutex.Unlock()
+
+	msgs := loadConversation(key)
+	last := len(msgs) - 1
+	if last < 1 || msgs[last].Role != "assistant" {
+		return false
 	}
 
-	contexts[chatID] = append(contexts[chatID], LMMessage{Role: role, Content: content})
-	trimConversation(chatID)
+	msgs[last].Content = content
+	saveConversation(key, msgs)
+	return true
 }
 
-// Context updating for Streaming-mode (with the possibility of reset)
-func updateConversationContextStream(chatID int64, role, content string) {
+// Removing the last answer of the model (for the regeneration), returns false if there is no answer
+func dropLastAssistantMessage(key conversationKey) bool {
 	ctxMutex.Lock()
 	defer ctxMutex.Unlock()
 
-	if _, ok := contexts[chatID]; !ok {
-		contexts[chatID] = []LMMessage{
-			{Role: "system", Content: config.SystemRole},
-		}
+	msgs := loadConversation(key)
+	last := len(msgs) - 1
+	if last < 1 || msgs[last].Role != "assistant" {
+		return false
 	}
 
-	contexts[chatID] = append(contexts[chatID], LMMessage{Role: role, Content: content})
+	saveConversation(key, msgs[:last])
+	return true
 }
 
 // Context clear
-func clearConversationContext(chatID int64) {
-	contexts[chatID] = []LMMessage{
+func clearConversationContext(key conversationKey) {
+	ctxMutex.Lock()
+	defer ctxMutex.Unlock()
+
+	saveConversation(key, []LMMessage{
 		{Role: "system", Content: config.SystemRole},
-	}
+	})
 }
 
-// Function of the sub-count "tokens" (example on the number of words)
-func countTokens(messages []LMMessage) int {
-	total := 0
-	for _, m := range messages {
-		total += len(strings.Fields(m.Content))
+// Removing the history of the conversation
+func deleteConversationContext(key conversationKey) {
+	ctxMutex.Lock()
+	defer ctxMutex.Unlock()
+
+	if err := conversations.Delete(key); err != nil {
+		logger.Errorf("Error deleting conversation %v: %v", key, err)
 	}
-	return total
 }
 
-// Removing the oldest messages if the tokens limits are exceeded
-func trimConversation(chatID int64) {
-	msgs := contexts[chatID]
-	for countTokens(msgs) > config.TokenLimit && len(msgs) > 1 {
+// Removing the oldest messages if the limit of tokens is exceeded
+func trimConversation(model string, limit int, msgs []LMMessage) []LMMessage {
+	for estimateTokens(model, msgs...) > limit && len(msgs) > 1 {
 		// Leave a system message
 		msgs = append(msgs[:1], msgs[2:]...)
 	}
-	contexts[chatID] = msgs
-}
-
-// Converting markdown to telegram format
-func convertToTelegramFormat(text string) string {
-	// We hide the contents of <think> tags under spoilers
-	thinkRe := regexp.MustCompile(`(?s)<think>(.*?)</think>`)
-	text = thinkRe.ReplaceAllStringFunc(text, func(match string) string {
-		content := thinkRe.ReplaceAllString(match, "$1")
-		return "```\n" + strings.TrimSpace(content) + "```"
-	})
-
-	// Markdown transformation into Telegram-compatible format
-	text = strings.ReplaceAll(text, "**", "*") // Bold -> bold
-	text = strings.ReplaceAll(text, "__", "_") // Emphasis -> italics
-	text = strings.ReplaceAll(text, "~~", "~") // Emphasis -> italics
-
-	// We remove the headlines of Markdown
-	headingRe := regexp.MustCompile(`(?m)^#{1,6}\s*`)
-	text = headingRe.ReplaceAllString(text, "")
-
-	logger.Debugf("convertToTelegramFormat: %v", text)
-
-	return text
+	return msgs
 }
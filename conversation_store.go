@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ConversationStore Storage of dialogue contexts of chats
+type ConversationStore interface {
+	// Load returns the chat history or nil if there is no history yet
+	Load(key conversationKey) ([]LMMessage, error)
+	// Save replaces the chat history
+	Save(key conversationKey, messages []LMMessage) error
+	// Delete removes the chat history
+	Delete(key conversationKey) error
+}
+
+// Creating a storage by the configuration: "memory" or "file" (by default)
+func newConversationStore() (ConversationStore, error) {
+	switch config.ConversationStore {
+	case "memory":
+		return newMemoryConversationStore(), nil
+	case "", "file":
+		dir := config.ConversationDir
+		if dir == "" {
+			dir = "conversations"
+		}
+		return newFileConversationStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown conversation store: %s", config.ConversationStore)
+	}
+}
+
+// Copy of the history so that callers do not change the stored slice
+func copyMessages(messages []LMMessage) []LMMessage {
+	if messages == nil {
+		return nil
+	}
+	result := make([]LMMessage, len(messages))
+	copy(result, messages)
+	return result
+}
+
+// --------------------------
+// Storage in memory (history is lost on restart)
+// --------------------------
+
+type memoryConversationStore struct {
+	mu       sync.Mutex
+	contexts map[conversationKey][]LMMessage
+}
+
+func newMemoryConversationStore() *memoryConversationStore {
+	return &memoryConversationStore{contexts: make(map[conversationKey][]LMMessage)}
+}
+
+func (s *memoryConversationStore) Load(key conversationKey) ([]LMMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyMessages(s.contexts[key]), nil
+}
+
+func (s *memoryConversationStore) Save(key conversationKey, messages []LMMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.contexts[key] = copyMessages(messages)
+	return nil
+}
+
+func (s *memoryConversationStore) Delete(key conversationKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.contexts, key)
+	return nil
+}
+
+// --------------------------
+// Storage in JSON files (one file per conversation)
+// --------------------------
+
+type fileConversationStore struct {
+	mu    sync.Mutex
+	dir   string
+	cache map[conversationKey][]LMMessage // Loaded chats, files are read lazily on first access
+}
+
+func newFileConversationStore(dir string) (*fileConversationStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating conversation directory: %v", err)
+	}
+
+	return &fileConversationStore{
+		dir:   dir,
+		cache: make(map[conversationKey][]LMMessage),
+	}, nil
+}
+
+// The path to the conversation file
+func (s *fileConversationStore) path(key conversationKey) string {
+	return filepath.Join(s.dir, key.fileName())
+}
+
+func (s *fileConversationStore) Load(key conversationKey) ([]LMMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if messages, ok := s.cache[key]; ok {
+		return copyMessages(messages), nil
+	}
+
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var messages []LMMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("error parsing conversation %v: %v", key, err)
+	}
+
+	s.cache[key] = messages
+	return copyMessages(messages), nil
+}
+
+func (s *fileConversationStore) Save(key conversationKey, messages []LMMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(messages, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path(key), data, 0644); err != nil {
+		return err
+	}
+
+	s.cache[key] = copyMessages(messages)
+	return nil
+}
+
+func (s *fileConversationStore) Delete(key conversationKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.cache, key)
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Writing a file through a temporary file and renaming, so that the file is never half-written
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, fileName)
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/ledongthuc/pdf"
+)
+
+const (
+	// The largest document that the bot accepts
+	maxDocumentSize = 10 * 1024 * 1024
+	// Size of a fragment of a document that does not fit into the context
+	documentChunkTokens = 512
+	// Directory with the documents of conversations
+	documentsDir = "documents"
+)
+
+// ChatDocument A document attached to the conversation, its text is added to the context of requests
+type ChatDocument struct {
+	ID      string          `json:"id"` // Stable identifier for the buttons of /docs
+	Name    string          `json:"name"`
+	Content string          `json:"content"`
+	Tokens  int             `json:"tokens"`
+	Chunks  []DocumentChunk `json:"chunks,omitempty"` // Fragments for the documents that do not fit into the context
+	Added   time.Time       `json:"added"`
+}
+
+// DocumentChunk A fragment of a document, split when the document is attached
+type DocumentChunk struct {
+	Text   string `json:"text"`
+	Tokens int    `json:"tokens"`
+}
+
+// rankedChunk A fragment of a document selected for the context
+type rankedChunk struct {
+	doc    int
+	index  int
+	total  int
+	text   string
+	tokens int
+	score  int
+}
+
+var (
+	errUnsupportedDocument = errors.New("unsupported document type")
+	errDocumentNotFound    = errors.New("the document is not attached")
+
+	// Documents of conversations (loaded from the files on first access)
+	chatDocuments  = make(map[conversationKey][]*ChatDocument)
+	documentsMutex sync.Mutex
+)
+
+// The file with the documents of the conversation
+func documentsFileName(key conversationKey) string {
+	return filepath.Join(documentsDir, key.fileName())
+}
+
+// Documents of the conversation; the caller holds documentsMutex
+func loadChatDocumentsLocked(key conversationKey) []*ChatDocument {
+	if docs, ok := chatDocuments[key]; ok {
+		return docs
+	}
+
+	var docs []*ChatDocument
+	data, err := os.ReadFile(documentsFileName(key))
+	if err == nil {
+		if err := json.Unmarshal(data, &docs); err != nil {
+			logger.Errorf("Error loading documents of conversation %s: %v", key, err)
+		}
+	} else if !os.IsNotExist(err) {
+		logger.Errorf("Error loading documents of conversation %s: %v", key, err)
+	}
+
+	// Documents saved without fragments are split once, documents without IDs get them
+	for _, doc := range docs {
+		if len(doc.Chunks) == 0 {
+			doc.Chunks = splitDocument(doc.Content)
+		}
+		if doc.ID == "" {
+			doc.ID = documentID(doc.Added)
+		}
+	}
+
+	chatDocuments[key] = docs
+	return docs
+}
+
+// Saving the documents of the conversation; the caller holds documentsMutex
+func saveChatDocumentsLocked(key conversationKey) error {
+	docs := chatDocuments[key]
+	if len(docs) == 0 {
+		err := os.Remove(documentsFileName(key))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(documentsDir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(docs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(documentsFileName(key), data, 0644)
+}
+
+// Copy of the list of documents of the conversation
+func listChatDocuments(key conversationKey) []ChatDocument {
+	documentsMutex.Lock()
+	defer documentsMutex.Unlock()
+
+	var result []ChatDocument
+	for _, doc := range loadChatDocumentsLocked(key) {
+		result = append(result, *doc)
+	}
+	return result
+}
+
+// Attaching a document to the conversation (a document with the same name is replaced)
+func addChatDocument(key conversationKey, doc *ChatDocument) error {
+	documentsMutex.Lock()
+	defer documentsMutex.Unlock()
+
+	docs := loadChatDocumentsLocked(key)
+	replaced := false
+	for i, existing := range docs {
+		if existing.Name == doc.Name {
+			docs[i] = doc
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		docs = append(docs, doc)
+	}
+	chatDocuments[key] = docs
+
+	return saveChatDocumentsLocked(key)
+}
+
+// Removing the document by its ID, returns the name of the removed document
+func removeChatDocument(key conversationKey, id string) (string, error) {
+	documentsMutex.Lock()
+	defer documentsMutex.Unlock()
+
+	docs := loadChatDocumentsLocked(key)
+	for i, doc := range docs {
+		if doc.ID == id {
+			chatDocuments[key] = append(docs[:i:i], docs[i+1:]...)
+			return doc.Name, saveChatDocumentsLocked(key)
+		}
+	}
+	return "", errDocumentNotFound
+}
+
+// The ID of the document by the time it was attached
+func documentID(added time.Time) string {
+	return strconv.FormatInt(added.UnixNano(), 36)
+}
+
+// Removing all documents of the conversation
+func clearChatDocuments(key conversationKey) error {
+	documentsMutex.Lock()
+	defer documentsMutex.Unlock()
+
+	chatDocuments[key] = nil
+	return saveChatDocumentsLocked(key)
+}
+
+// Removing the documents of all reply chains of the group (the topics keep their documents)
+func clearGroupDocuments(chatID int64) error {
+	documentsMutex.Lock()
+	defer documentsMutex.Unlock()
+
+	for key := range chatDocuments {
+		if key.ChatID == chatID && key.TopicID == 0 {
+			delete(chatDocuments, key)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(documentsDir, strconv.FormatInt(chatID, 10)+"_*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasPrefix(filepath.Base(file), strconv.FormatInt(chatID, 10)+"_t") {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Downloading the document sent to the bot and extracting its text
+func ingestDocument(doc *tgbotapi.Document) (*ChatDocument, error) {
+	if doc.FileSize > maxDocumentSize {
+		return nil, fmt.Errorf("the document is larger than %d bytes", maxDocumentSize)
+	}
+
+	data, err := downloadTelegramFile(doc.FileID, maxDocumentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := extractDocumentText(doc.FileName, doc.MimeType, data)
+	if err != nil {
+		return nil, err
+	}
+
+	name := doc.FileName
+	if name == "" {
+		name = "document"
+	}
+
+	added := time.Now()
+	return &ChatDocument{
+		ID:      documentID(added),
+		Name:    name,
+		Content: content,
+		Tokens:  tokenizer.CountTokens(content),
+		Chunks:  splitDocument(content),
+		Added:   added,
+	}, nil
+}
+
+// Splitting the text of a document into fragments with their sizes in tokens
+func splitDocument(content string) []DocumentChunk {
+	var chunks []DocumentChunk
+	for _, text := range chunkText(content, documentChunkTokens) {
+		chunks = append(chunks, DocumentChunk{Text: text, Tokens: tokenizer.CountTokens(text)})
+	}
+	return chunks
+}
+
+// Extracting the text of a document: PDF or any text file (plain text, Markdown, source code)
+func extractDocumentText(name, mimeType string, data []byte) (string, error) {
+	var text string
+	if mimeType == "application/pdf" || strings.EqualFold(filepath.Ext(name), ".pdf") {
+		var err error
+		if text, err = extractPDFText(data); err != nil {
+			return "", err
+		}
+	} else {
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // BOM
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			return "", errUnsupportedDocument
+		}
+		text = string(data)
+	}
+
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	if text == "" {
+		return "", errors.New("the document contains no text")
+	}
+	return text, nil
+}
+
+// The text of all pages of a PDF document
+func extractPDFText(data []byte) (text string, err error) {
+	// The PDF library panics on some damaged files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("PDF reading error: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+
+	content, err := io.ReadAll(plain)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// Text of the attached documents for the context of the request. If the documents do not fit into
+// the budget, the fragments most relevant to the query are selected.
+func documentContext(key conversationKey, model, query string, budget int) string {
+	docs := listChatDocuments(key)
+	if len(docs) == 0 || budget <= 0 {
+		return ""
+	}
+
+	const header = "The user attached documents to the chat. Use them to answer the questions.\n\n"
+
+	// The sizes of the documents were counted when they were attached
+	used := estimateTokens(model, LMMessage{Role: "system", Content: header})
+	total := used
+	for _, doc := range docs {
+		total += doc.Tokens + tokenizer.CountTokens(formatDocument(doc.Name, "", ""))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(header)
+	if total <= budget {
+		for _, doc := range docs {
+			sb.WriteString(formatDocument(doc.Name, "", doc.Content))
+		}
+		return strings.TrimSpace(sb.String())
+	}
+
+	// Fragments of all documents, ranked by the words of the query
+	terms := queryTerms(query)
+	var chunks []rankedChunk
+	for i, doc := range docs {
+		for j, part := range doc.Chunks {
+			chunks = append(chunks, rankedChunk{doc: i, index: j, total: len(doc.Chunks), text: part.Text, tokens: part.Tokens, score: termScore(part.Text, terms)})
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].score > chunks[j].score
+	})
+
+	var selected []rankedChunk
+	for _, chunk := range chunks {
+		tokens := chunk.tokens + messageTokenOverhead
+		if used+tokens > budget {
+			continue
+		}
+		used += tokens
+		selected = append(selected, chunk)
+	}
+	if len(selected) == 0 {
+		return ""
+	}
+
+	// The selected fragments are given in the order of the documents
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].doc != selected[j].doc {
+			return selected[i].doc < selected[j].doc
+		}
+		return selected[i].index < selected[j].index
+	})
+
+	for _, chunk := range selected {
+		fragment := fmt.Sprintf("fragment %d of %d", chunk.index+1, chunk.total)
+		sb.WriteString(formatDocument(docs[chunk.doc].Name, fragment, chunk.text))
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// A document (or its fragment) in the context
+func formatDocument(name, fragment, content string) string {
+	title := "Document: " + name
+	if fragment != "" {
+		title += " (" + fragment + ")"
+	}
+	return title + "\n\"\"\"\n" + content + "\n\"\"\"\n\n"
+}
+
+// Splitting a text into fragments of no more than maxTokens: by paragraphs, then by lines and characters
+func chunkText(text string, maxTokens int) []string {
+	var chunks []string
+	var current strings.Builder
+	currentTokens := 0
+
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			chunks = append(chunks, s)
+		}
+		current.Reset()
+		currentTokens = 0
+	}
+
+	var add func(piece, sep string)
+	add = func(piece, sep string) {
+		tokens := tokenizer.CountTokens(piece)
+		if tokens > maxTokens {
+			// The piece itself is too long: it is split into smaller ones
+			switch sep {
+			case "\n\n":
+				for _, line := range strings.Split(piece, "\n") {
+					add(line, "\n")
+				}
+			default:
+				runes := []rune(piece)
+				size := len(runes) * maxTokens / tokens
+				if size < 1 {
+					size = 1
+				}
+				for len(runes) > 0 {
+					n := min(size, len(runes))
+					add(string(runes[:n]), "")
+					runes = runes[n:]
+				}
+			}
+			return
+		}
+
+		// The separator between the pieces also takes tokens
+		sepTokens := 0
+		if current.Len() > 0 {
+			sepTokens = tokenizer.CountTokens(sep)
+		}
+		if currentTokens+sepTokens+tokens > maxTokens {
+			flush()
+			sepTokens = 0
+		}
+		if current.Len() > 0 {
+			current.WriteString(sep)
+		}
+		current.WriteString(piece)
+		currentTokens += sepTokens + tokens
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		add(paragraph, "\n\n")
+	}
+	flush()
+
+	return chunks
+}
+
+// Words of the query for ranking the fragments (short words are skipped)
+func queryTerms(query string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(word) < 3 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// Number of occurrences of the words of the query in the fragment
+func termScore(text string, terms []string) int {
+	lower := strings.ToLower(text)
+	score := 0
+	for _, term := range terms {
+		score += strings.Count(lower, term)
+	}
+	return score
+}
+
+// The text of the last message of the user (the query for selecting fragments of documents)
+func lastUserMessage(msgs []LMMessage) string {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			return msgs[i].Content
+		}
+	}
+	return ""
+}
+
+// Adding the text to the system message of the request (or a new system message at the beginning)
+func withSystemContext(msgs []LMMessage, text string) []LMMessage {
+	if text == "" {
+		return msgs
+	}
+	if len(msgs) > 0 && msgs[0].Role == "system" {
+		msgs[0].Content = strings.TrimSpace(msgs[0].Content + "\n\n" + text)
+		return msgs
+	}
+	return append([]LMMessage{{Role: "system", Content: text}}, msgs...)
+}
+
+// Command /docs: the list of documents of the conversation with buttons for removing them
+func docsCommand(key conversationKey) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(key.ChatID, "")
+	docs := listChatDocuments(key)
+	if len(docs) == 0 {
+		msg.Text = t("No documents are attached to this chat. Send a text, Markdown, code or PDF file to attach it.")
+		return msg
+	}
+
+	var lines []string
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, doc := range docs {
+		lines = append(lines, t("%d. %s (%d tokens)", i+1, doc.Name, doc.Tokens))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗑 "+doc.Name, callbackData("doc", doc.ID)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(t("🗑 Remove all"), callbackData("doc", "all")),
+	))
+
+	msg.Text = t("Documents of this chat:") + "\n" + strings.Join(lines, "\n")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return msg
+}
+
+// Pressing the button for removing a document in the /docs list
+func handleDocumentCallback(query *tgbotapi.CallbackQuery, data string) string {
+	key := messageConversation(query.Message)
+
+	var answer string
+	if data == "all" {
+		if err := clearChatDocuments(key); err != nil {
+			logger.Errorf("Error removing documents: %v", err)
+			return t("Error removing the document.")
+		}
+		answer = t("All documents are removed.")
+	} else {
+		// The list could be outdated: the document is already removed or replaced
+		name, err := removeChatDocument(key, data)
+		switch {
+		case errors.Is(err, errDocumentNotFound):
+			answer = t("The document is already removed.")
+		case err != nil:
+			logger.Errorf("Error removing document: %v", err)
+			return t("Error removing the document.")
+		default:
+			answer = t("Document \"%s\" is removed.", name)
+		}
+	}
+
+	// The list is updated in place
+	list := docsCommand(key)
+	edit := tgbotapi.NewEditMessageText(key.ChatID, query.Message.MessageID, list.Text)
+	if markup, ok := list.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+		edit.ReplyMarkup = &markup
+	}
+	if _, err := bot.Request(edit); err != nil {
+		logger.Errorf("Error editing message: %v", err)
+	}
+
+	return answer
+}
+
+// Attaching the document sent to the conversation, the user is told the result in the conversation
+func attachDocument(key conversationKey, doc *tgbotapi.Document) bool {
+	chatDoc, err := ingestDocument(doc)
+	if err != nil {
+		logger.Errorf("Error reading document %s: %v", doc.FileName, err)
+		text := t("Failed to read the document.")
+		if errors.Is(err, errUnsupportedDocument) {
+			text = t("Unsupported document type. Text, Markdown, code and PDF files are supported.")
+		}
+		_, _ = sendTo(key, tgbotapi.NewMessage(key.ChatID, text))
+		return false
+	}
+
+	if err := addChatDocument(key, chatDoc); err != nil {
+		logger.Errorf("Error saving document: %v", err)
+		_, _ = sendTo(key, tgbotapi.NewMessage(key.ChatID, t("Failed to read the document.")))
+		return false
+	}
+
+	text := t("📎 Document \"%s\" is attached (%d tokens). Use /docs to manage the documents.", chatDoc.Name, chatDoc.Tokens)
+	if sent, err := sendTo(key, tgbotapi.NewMessage(key.ChatID, text)); err == nil {
+		// The replies to the message continue the conversation of the document
+		rememberReplyChain(key, sent.MessageID)
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	savedTokenizer := tokenizer
+	defer func() { tokenizer = savedTokenizer }()
+	tokenizer = approxTokenizer{}
+
+	tests := []struct {
+		name      string
+		text      string
+		maxTokens int
+	}{
+		{"short text", "A single short paragraph.", 50},
+		{"paragraphs", strings.Repeat("alpha beta gamma delta.\n\n", 200), 50},
+		{"long lines", strings.Repeat("one two three four five six seven eight nine ten\n", 100), 30},
+		{"one huge line", strings.Repeat("word ", 2000), 40},
+		{"text without spaces", strings.Repeat("ж", 3000), 64},
+		{"cyrillic paragraphs", strings.Repeat("Съешь же ещё этих мягких французских булок.\n\n", 100), 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkText(tt.text, tt.maxTokens)
+			if len(chunks) == 0 {
+				t.Fatal("no chunks")
+			}
+
+			for i, chunk := range chunks {
+				if strings.TrimSpace(chunk) == "" {
+					t.Errorf("chunk %d is empty", i)
+				}
+				if tokens := tokenizer.CountTokens(chunk); tokens > tt.maxTokens {
+					t.Errorf("chunk %d has %d tokens, limit %d", i, tokens, tt.maxTokens)
+				}
+			}
+
+			// The chunks do not overlap and nothing is lost: together they give the text again
+			if got, want := strings.Join(strings.Fields(strings.Join(chunks, "")), ""), strings.Join(strings.Fields(tt.text), ""); got != want {
+				t.Errorf("the chunks do not make up the text: %d characters instead of %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestDocumentContext(t *testing.T) {
+	chdirTemp(t)
+
+	savedTokenizer := tokenizer
+	defer func() { tokenizer = savedTokenizer }()
+	tokenizer = approxTokenizer{}
+
+	key := conversationKey{ChatID: -100, RootID: 7}
+	content := strings.Repeat("Filler text about nothing in particular.\n\n", 300) +
+		"The secret password is swordfish.\n\n" +
+		strings.Repeat("More filler text without any meaning.\n\n", 300)
+	doc := &ChatDocument{Name: "notes.txt", Content: content, Tokens: tokenizer.CountTokens(content), Chunks: splitDocument(content)}
+	if err := addChatDocument(key, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The whole document fits into a large budget
+	if got := documentContext(key, "model", "anything", 1<<20); !strings.Contains(got, content[:100]) || strings.Contains(got, "fragment") {
+		t.Error("the whole document is expected in a large budget")
+	}
+
+	// A small budget gets the fragment that matches the question
+	got := documentContext(key, "model", "What is the secret password?", 2*documentChunkTokens)
+	if !strings.Contains(got, "swordfish") {
+		t.Errorf("the matching fragment is not selected:\n%s", got)
+	}
+	if tokens := estimateTokens("model", LMMessage{Role: "system", Content: got}); tokens > 2*documentChunkTokens {
+		t.Errorf("the context has %d tokens, budget %d", tokens, 2*documentChunkTokens)
+	}
+
+	// Other conversations do not see the document
+	if got := documentContext(conversationKey{ChatID: -100, RootID: 8}, "model", "password", 1<<20); got != "" {
+		t.Errorf("the document of another conversation is used: %q", got[:min(len(got), 50)])
+	}
+}
+
+func TestRemoveChatDocument(t *testing.T) {
+	chdirTemp(t)
+
+	key := conversationKey{ChatID: -200, RootID: 1}
+	first := &ChatDocument{ID: "a", Name: "first.txt", Content: "one"}
+	second := &ChatDocument{ID: "b", Name: "second.txt", Content: "two"}
+	for _, doc := range []*ChatDocument{first, second} {
+		if err := addChatDocument(key, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The buttons keep the IDs: removing the first document does not shift the second one
+	if name, err := removeChatDocument(key, "a"); err != nil || name != "first.txt" {
+		t.Fatalf("removing the first document: %q, %v", name, err)
+	}
+	if _, err := removeChatDocument(key, "a"); !errors.Is(err, errDocumentNotFound) {
+		t.Errorf("removing it again: %v, want errDocumentNotFound", err)
+	}
+	if docs := listChatDocuments(key); len(docs) != 1 || docs[0].ID != "b" {
+		t.Errorf("the documents left: %+v", docs)
+	}
+}
+
+func TestClearGroupDocuments(t *testing.T) {
+	chdirTemp(t)
+
+	chain := conversationKey{ChatID: -300, RootID: 5}
+	topic := conversationKey{ChatID: -300, TopicID: 9}
+	other := conversationKey{ChatID: -301, RootID: 5}
+	for _, key := range []conversationKey{chain, topic, other} {
+		if err := addChatDocument(key, &ChatDocument{ID: "x", Name: "doc.txt", Content: "text"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := clearGroupDocuments(-300); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(documentsFileName(chain)); !os.IsNotExist(err) {
+		t.Errorf("the documents of the chain are left: %v", err)
+	}
+	if len(listChatDocuments(chain)) != 0 {
+		t.Error("the documents of the chain are still listed")
+	}
+	for _, key := range []conversationKey{topic, other} {
+		if len(listChatDocuments(key)) != 1 {
+			t.Errorf("the documents of %s are removed", key)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var (
+	// Running generations of each conversation, to cancel them by /stop
+	generations      = make(map[conversationKey]map[int]context.CancelFunc)
+	generationsMutex sync.Mutex
+	lastGenerationID int
+)
+
+// Registration of a new generation of the conversation. Returns the context of the generation
+// and the function that must be called when the generation is completed.
+func startGeneration(key conversationKey) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	generationsMutex.Lock()
+	lastGenerationID++
+	id := lastGenerationID
+	if generations[key] == nil {
+		generations[key] = make(map[int]context.CancelFunc)
+	}
+	generations[key][id] = cancel
+	generationsMutex.Unlock()
+
+	return ctx, func() {
+		generationsMutex.Lock()
+		delete(generations[key], id)
+		if len(generations[key]) == 0 {
+			delete(generations, key)
+		}
+		generationsMutex.Unlock()
+		cancel()
+	}
+}
+
+// Cancellation of all running generations of the conversation, returns false if there were none
+func stopGeneration(key conversationKey) bool {
+	generationsMutex.Lock()
+	defer generationsMutex.Unlock()
+
+	stopped := false
+	for k, running := range generations {
+		if !key.contains(k) {
+			continue
+		}
+		for _, cancel := range running {
+			cancel()
+			stopped = true
+		}
+		delete(generations, k)
+	}
+
+	return stopped
+}
+
+// Checking that the error is caused by the cancellation of the generation
+func isGenerationStopped(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != nil && errors.Is(err, context.Canceled)
+}
+
+// The "Stop" button under the message being generated
+func stopKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(t("⏹ Stop"), callbackData("stop", "")),
+		),
+	)
+}
+
+// The /stop command: the running generation of the conversation is cancelled
+// and its waiting requests are removed
+func stopCommand(key conversationKey) string {
+	stopped := stopGeneration(key)
+	if cancelQueuedGenerations(key) || stopped {
+		return t("Generation stopped.")
+	}
+	return t("Nothing to stop.")
+}
+
+// The "Stop" button
+func handleStopCallback(query *tgbotapi.CallbackQuery, _ string) string {
+	return stopCommand(messageConversation(query.Message))
+}
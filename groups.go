@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// The number of remembered messages of the reply chains of a chat, the oldest ones are forgotten
+	maxChainMessages = 1000
+	// The number of chats with remembered reply chains, the chats unused for the longest time are forgotten
+	maxChainChats = 500
+	// The reply chains change with every answer in a group, so they are saved no more often than this
+	replyChainsSaveDelay = 10 * time.Second
+)
+
+// conversationKey A conversation with the bot: the whole private chat, a topic of a forum
+// or a reply chain of a group
+type conversationKey struct {
+	ChatID  int64
+	TopicID int // The topic of the forum (message_thread_id)
+	RootID  int // The first message of the reply chain (0 - the whole chat or topic)
+}
+
+// The key of the conversation with the whole chat
+func chatConversation(chatID int64) conversationKey {
+	return conversationKey{ChatID: chatID}
+}
+
+func (k conversationKey) String() string {
+	switch {
+	case k.TopicID != 0:
+		return fmt.Sprintf("%d#%d", k.ChatID, k.TopicID)
+	case k.RootID != 0:
+		return fmt.Sprintf("%d/%d", k.ChatID, k.RootID)
+	default:
+		return strconv.FormatInt(k.ChatID, 10)
+	}
+}
+
+// Whether the conversation belongs to this one: the key of the whole chat
+// includes all conversations of the chat (its topics and reply chains)
+func (k conversationKey) contains(other conversationKey) bool {
+	if k.TopicID == 0 && k.RootID == 0 {
+		return k.ChatID == other.ChatID
+	}
+	return k == other
+}
+
+// The name of the file of the conversation: "<chat>.json", "<chat>_t<topic>.json" for a topic of a forum
+// or "<chat>_<root>.json" for a reply chain
+func (k conversationKey) fileName() string {
+	switch {
+	case k.TopicID != 0:
+		return fmt.Sprintf("%d_t%d.json", k.ChatID, k.TopicID)
+	case k.RootID != 0:
+		return fmt.Sprintf("%d_%d.json", k.ChatID, k.RootID)
+	default:
+		return fmt.Sprintf("%d.json", k.ChatID)
+	}
+}
+
+var (
+	// The messages of the reply chains of the groups: chat -> message -> the first message of the chain
+	replyChains         = make(map[int64]map[int]int)
+	replyChainsFileName = "reply_chains.json"
+	replyChainsMutex    sync.Mutex
+	// The last use of the reply chains of the chats (the chats loaded from the file are used at the start)
+	replyChainsUsed = make(map[int64]time.Time)
+	// The pending save of the changed reply chains
+	replyChainsTimer *time.Timer
+)
+
+// Loading the reply chains from a file
+func loadReplyChains() error {
+	replyChainsMutex.Lock()
+	defer replyChainsMutex.Unlock()
+
+	data, err := os.ReadFile(replyChainsFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			replyChains = make(map[int64]map[int]int)
+			return nil
+		}
+		return err
+	}
+
+	loaded := make(map[int64]map[int]int)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	replyChains = loaded
+	replyChainsUsed = make(map[int64]time.Time)
+	for chatID := range loaded {
+		replyChainsUsed[chatID] = time.Now()
+	}
+	return nil
+}
+
+// Saving the changed reply chains later, several changes are written at once
+func scheduleReplyChainsSaveLocked() {
+	if replyChainsTimer == nil {
+		replyChainsTimer = time.AfterFunc(replyChainsSaveDelay, flushReplyChains)
+	}
+}
+
+// Saving the changed reply chains now (on exit the pending changes must not be lost)
+func flushReplyChains() {
+	replyChainsMutex.Lock()
+	defer replyChainsMutex.Unlock()
+
+	if replyChainsTimer != nil {
+		saveReplyChainsLocked()
+	}
+}
+
+// Saving the reply chains to a file
+func saveReplyChainsLocked() {
+	if replyChainsTimer != nil {
+		replyChainsTimer.Stop()
+		replyChainsTimer = nil
+	}
+
+	data, err := json.MarshalIndent(replyChains, "", "  ")
+	if err != nil {
+		logger.Errorf("Error saving reply chains: %v", err)
+		return
+	}
+	if err := writeFileAtomic(replyChainsFileName, data, 0644); err != nil {
+		logger.Errorf("Error saving reply chains: %v", err)
+	}
+}
+
+// Whether the chat is a group or a supergroup
+func isGroupChat(chat *tgbotapi.Chat) bool {
+	return chat != nil && (chat.IsGroup() || chat.IsSuperGroup())
+}
+
+// Whether the author of the message may change the settings of the chat: anyone in a private chat,
+// in groups only the administrators of the group (including anonymous ones) and of the bot
+func canChangeChatSettings(message *tgbotapi.Message) bool {
+	if !isGroupChat(message.Chat) {
+		return true
+	}
+	// An anonymous administrator writes on behalf of the group itself
+	if message.SenderChat != nil && message.SenderChat.ID == message.Chat.ID {
+		return true
+	}
+	if message.From == nil {
+		return false
+	}
+	if isAdmin(message.From.ID) {
+		return true
+	}
+
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: message.Chat.ID, UserID: message.From.ID},
+	})
+	if err != nil {
+		logger.Errorf("Error getting chat member: %v", err)
+		return false
+	}
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// The conversation of a new message: each topic of a forum is a conversation,
+// in other groups the reply to a message continues its chain, other messages begin a new chain
+func promptConversation(message *tgbotapi.Message) conversationKey {
+	if !isGroupChat(message.Chat) {
+		return chatConversation(message.Chat.ID)
+	}
+	if topic := messageTopic(message); topic != 0 {
+		return conversationKey{ChatID: message.Chat.ID, TopicID: topic}
+	}
+	if reply := message.ReplyToMessage; reply != nil {
+		return messageConversation(reply)
+	}
+	return conversationKey{ChatID: message.Chat.ID, RootID: message.MessageID}
+}
+
+// The conversation to which the message belongs (for the buttons and the replies to the message)
+func messageConversation(message *tgbotapi.Message) conversationKey {
+	if !isGroupChat(message.Chat) {
+		return chatConversation(message.Chat.ID)
+	}
+	if topic := messageTopic(message); topic != 0 {
+		return conversationKey{ChatID: message.Chat.ID, TopicID: topic}
+	}
+
+	replyChainsMutex.Lock()
+	defer replyChainsMutex.Unlock()
+
+	if root, ok := replyChains[message.Chat.ID][message.MessageID]; ok {
+		return conversationKey{ChatID: message.Chat.ID, RootID: root}
+	}
+	// A forgotten message begins a new chain
+	return conversationKey{ChatID: message.Chat.ID, RootID: message.MessageID}
+}
+
+// Remembering the messages of the reply chain, so that the replies to them continue the conversation
+func rememberReplyChain(key conversationKey, messageIDs ...int) {
+	if key.RootID == 0 || len(messageIDs) == 0 {
+		return
+	}
+
+	replyChainsMutex.Lock()
+	defer replyChainsMutex.Unlock()
+
+	chain := replyChains[key.ChatID]
+	if chain == nil {
+		chain = make(map[int]int)
+		replyChains[key.ChatID] = chain
+	}
+	replyChainsUsed[key.ChatID] = time.Now()
+	forgetUnusedChainChatsLocked()
+	for _, id := range messageIDs {
+		chain[id] = key.RootID
+	}
+
+	// Message IDs grow, so the smallest ones are the oldest
+	if extra := len(chain) - maxChainMessages; extra > 0 {
+		ids := make([]int, 0, len(chain))
+		for id := range chain {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		for _, id := range ids[:extra] {
+			delete(chain, id)
+		}
+	}
+
+	scheduleReplyChainsSaveLocked()
+}
+
+// Forgetting the reply chains of the chats unused for the longest time above the limit of chats
+func forgetUnusedChainChatsLocked() {
+	extra := len(replyChains) - maxChainChats
+	if extra <= 0 {
+		return
+	}
+
+	chats := make([]int64, 0, len(replyChains))
+	for chatID := range replyChains {
+		chats = append(chats, chatID)
+	}
+	slices.SortFunc(chats, func(a, b int64) int {
+		return replyChainsUsed[a].Compare(replyChainsUsed[b])
+	})
+	for _, chatID := range chats[:extra] {
+		delete(replyChains, chatID)
+		delete(replyChainsUsed, chatID)
+	}
+}
+
+// Forgetting all reply chains of the group, returns the conversations of the chains
+func forgetReplyChains(chatID int64) []conversationKey {
+	replyChainsMutex.Lock()
+	defer replyChainsMutex.Unlock()
+
+	var keys []conversationKey
+	for _, root := range replyChains[chatID] {
+		key := conversationKey{ChatID: chatID, RootID: root}
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	delete(replyChains, chatID)
+	delete(replyChainsUsed, chatID)
+	saveReplyChainsLocked()
+	return keys
+}
+
+// The mention of the bot in the text ("@BotName")
+func botMentionPattern() *regexp.Regexp {
+	return regexp.MustCompile(`(?i)@` + regexp.QuoteMeta(bot.Self.UserName) + `\b`)
+}
+
+// Whether the message of the group is addressed to the bot: a command (not to another bot),
+// a mention of the bot or a reply to a message of the bot.
+// Messages of private chats are always addressed to the bot.
+func isAddressedToBot(message *tgbotapi.Message) bool {
+	if !isGroupChat(message.Chat) {
+		return true
+	}
+
+	if message.IsCommand() {
+		_, target, found := strings.Cut(message.CommandWithAt(), "@")
+		return !found || strings.EqualFold(target, bot.Self.UserName)
+	}
+
+	if reply := message.ReplyToMessage; reply != nil && reply.From != nil && reply.From.ID == bot.Self.ID {
+		return true
+	}
+
+	mention := botMentionPattern()
+	return mention.MatchString(message.Text) || mention.MatchString(message.Caption)
+}
+
+// The text of the message without the mention of the bot
+func withoutBotMention(text string) string {
+	return strings.TrimSpace(botMentionPattern().ReplaceAllString(text, ""))
+}
+
+// Whether the bot works in the group: the denied groups never, the allowed ones (if they are set) only
+func isGroupAllowed(chatID int64) bool {
+	if slices.Contains(config.DeniedGroups, chatID) {
+		return false
+	}
+	return len(config.AllowedGroups) == 0 || slices.Contains(config.AllowedGroups, chatID)
+}
+
+// The list of chat IDs separated by commas (for the GUI)
+func parseChatIDs(text string) ([]int64, error) {
+	var ids []int64
+	for _, field := range strings.Split(text, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("the wrong chat ID: %s", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// The chat IDs separated by commas (for the GUI)
+func formatChatIDs(ids []int64) string {
+	fields := make([]string, len(ids))
+	for i, id := range ids {
+		fields[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// The /clear command in a group without a reply: all conversations of the group and their documents are cleared
+func clearGroupConversations(chatID int64) {
+	for _, key := range forgetReplyChains(chatID) {
+		forgetLastReply(key)
+		deleteConversationContext(key)
+	}
+	if err := clearGroupDocuments(chatID); err != nil {
+		logger.Errorf("Error removing documents: %v", err)
+	}
+}
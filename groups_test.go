@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Empty reply chains, restored after the test
+func useReplyChains(t *testing.T) {
+	t.Helper()
+	chdirTemp(t)
+	savedChains, savedUsed := replyChains, replyChainsUsed
+	t.Cleanup(func() {
+		flushReplyChains()
+		replyChains, replyChainsUsed = savedChains, savedUsed
+	})
+	replyChains = make(map[int64]map[int]int)
+	replyChainsUsed = make(map[int64]time.Time)
+}
+
+func TestRememberReplyChainSavesLater(t *testing.T) {
+	useReplyChains(t)
+
+	key := conversationKey{ChatID: -100, RootID: 10}
+	for id := 11; id < 20; id++ {
+		rememberReplyChain(key, id)
+	}
+	if _, err := os.Stat(replyChainsFileName); !os.IsNotExist(err) {
+		t.Fatalf("the reply chains must not be saved on every message: %v", err)
+	}
+
+	flushReplyChains()
+	replyChains = nil
+	if err := loadReplyChains(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(replyChains[key.ChatID]); got != 9 {
+		t.Errorf("loaded %d messages of the chain, want 9", got)
+	}
+}
+
+func TestRememberReplyChainForgetsUnusedChats(t *testing.T) {
+	useReplyChains(t)
+
+	for chatID := int64(1); chatID <= maxChainChats+2; chatID++ {
+		rememberReplyChain(conversationKey{ChatID: -chatID, RootID: 1}, 2)
+		// The first chat stays in use
+		rememberReplyChain(conversationKey{ChatID: -1, RootID: 1}, 3)
+	}
+
+	if got := len(replyChains); got != maxChainChats {
+		t.Errorf("%d chats are remembered, want %d", got, maxChainChats)
+	}
+	if replyChains[-1] == nil {
+		t.Error("the chat in use is forgotten")
+	}
+	if replyChains[-2] != nil || replyChains[-3] != nil {
+		t.Error("the chats unused for the longest time are not forgotten")
+	}
+}
@@ -1,6 +1,9 @@
+//go:build !headless
+
 package main
 
 import (
+	"context"
 	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -10,14 +13,18 @@ import (
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// The program is built with the GUI (without the "headless" tag)
+const guiAvailable = true
+
 func botTabContent() *fyne.Container {
 	botControlButton := widget.NewButton(t("Launch Telegram bot"), nil)
 	statusLabel := widget.NewLabel(t("The bot is not launched"))
 
-	var pollingStopChan chan struct{}
+	var botStopChan chan struct{}
 	botRunning := false
 
 	startBot := func() bool {
@@ -27,19 +34,16 @@ func botTabContent() *fyne.Container {
 		}
 
 		statusLabel.SetText(t("The bot is running!"))
-		if config.UpdateMethod == "polling" {
-			pollingStopChan = make(chan struct{})
-			go startLongPolling(pollingStopChan)
-		} else if config.UpdateMethod == "webhook" {
-			go startWebhookServer()
-		}
+		botStopChan = make(chan struct{})
+		go startUpdates(botStopChan)
 
 		return true
 	}
 
 	stopBot := func() {
-		if config.UpdateMethod == "polling" && pollingStopChan != nil {
-			close(pollingStopChan)
+		if botStopChan != nil {
+			close(botStopChan)
+			botStopChan = nil
 		}
 		botRunning = false
 		statusLabel.SetText(t("The bot is stopped"))
@@ -124,6 +128,17 @@ func startGUI() {
 	apiAddressEntry.SetText(config.APIAddress)
 	apiAddressEntry.SetPlaceHolder("http://localhost:1234")
 
+	// Several LM Studio hosts, separated by commas (replace the single address)
+	apiAddressesEntry := widget.NewEntry()
+	apiAddressesEntry.SetText(strings.Join(config.APIAddresses, ", "))
+	apiAddressesEntry.SetPlaceHolder("http://host1:1234, http://host2:1234")
+
+	loadBalancingSelect := widget.NewSelect([]string{balanceRoundRobin, balanceLeastBusy}, func(val string) {
+		config.LoadBalancing = val
+	})
+	loadBalancingSelect.SetSelected(config.LoadBalancing)
+	loadBalancingSelect.PlaceHolder = t("Select the load balancing")
+
 	tokenLimitEntry := widget.NewEntry()
 	tokenLimitEntry.SetText(strconv.Itoa(config.TokenLimit))
 	tokenLimitEntry.SetPlaceHolder("2048")
@@ -132,6 +147,10 @@ func startGUI() {
 	timeoutEntry.SetText(strconv.Itoa(config.PollingTimeout))
 	timeoutEntry.SetPlaceHolder("60")
 
+	concurrencyEntry := widget.NewEntry()
+	concurrencyEntry.SetText(strconv.Itoa(config.MaxConcurrentRequests))
+	concurrencyEntry.SetPlaceHolder("1")
+
 	botTokenEntry := widget.NewPasswordEntry()
 	botTokenEntry.SetText(config.BotToken)
 	botTokenEntry.SetPlaceHolder(t("Enter the bot token"))
@@ -168,6 +187,61 @@ func startGUI() {
 	lmModeSelect.SetSelected(config.LMStudioMode)
 	lmModeSelect.PlaceHolder = t("Select the LM Studio mode")
 
+	reasoningSelect := widget.NewSelect([]string{reasoningHide, reasoningExpandable, reasoningSpoiler, reasoningMessage}, func(val string) {
+		config.ReasoningMode = val
+	})
+	reasoningSelect.SetSelected(reasoningMode())
+	reasoningSelect.PlaceHolder = t("Select the reasoning display")
+
+	tokenizerSelect := widget.NewSelect([]string{"approx", "bpe"}, func(val string) {
+		config.Tokenizer = val
+	})
+	tokenizerSelect.SetSelected(config.Tokenizer)
+	tokenizerSelect.PlaceHolder = t("Select a tokenizer")
+
+	tokenizerFileEntry := widget.NewEntry()
+	tokenizerFileEntry.SetText(config.TokenizerFile)
+	tokenizerFileEntry.SetPlaceHolder("tokenizer.json")
+
+	conversationStoreSelect := widget.NewSelect([]string{"memory", "file"}, func(val string) {
+		config.ConversationStore = val
+	})
+	conversationStoreSelect.SetSelected(config.ConversationStore)
+	conversationStoreSelect.PlaceHolder = t("Select the conversation storage")
+
+	sttAddressEntry := widget.NewEntry()
+	sttAddressEntry.SetText(config.STTAddress)
+	sttAddressEntry.SetPlaceHolder("http://localhost:8000/v1")
+
+	sttModelEntry := widget.NewEntry()
+	sttModelEntry.SetText(config.STTModel)
+	sttModelEntry.SetPlaceHolder("whisper-1")
+
+	// Generation parameters: an empty field - the parameter is not sent
+	samplingEntries := make([]*widget.Entry, len(samplingParams))
+	for i, param := range samplingParams {
+		samplingEntries[i] = widget.NewEntry()
+		samplingEntries[i].SetText(param.get(&config.SamplingParams))
+		samplingEntries[i].SetPlaceHolder(param.Hint)
+	}
+
+	toolsEntry := widget.NewEntry()
+	toolsEntry.SetText(strings.Join(config.Tools, ", "))
+	toolsEntry.SetPlaceHolder(strings.Join(toolNames(), ", "))
+
+	toolsDirEntry := widget.NewEntry()
+	toolsDirEntry.SetText(config.ToolsDir)
+	toolsDirEntry.SetPlaceHolder(t("Empty - file tools are disabled"))
+
+	// IDs of the group chats, separated by commas
+	allowedGroupsEntry := widget.NewEntry()
+	allowedGroupsEntry.SetText(formatChatIDs(config.AllowedGroups))
+	allowedGroupsEntry.SetPlaceHolder(t("Empty - any group"))
+
+	deniedGroupsEntry := widget.NewEntry()
+	deniedGroupsEntry.SetText(formatChatIDs(config.DeniedGroups))
+	deniedGroupsEntry.SetPlaceHolder("-1001234567890")
+
 	languageSelect := widget.NewSelect([]string{"en", "ru"}, func(val string) {
 		config.Language = val
 	})
@@ -176,6 +250,13 @@ func startGUI() {
 
 	saveConfigButton := widget.NewButtonWithIcon(t("Save the configuration"), theme.DocumentSaveIcon(), func() {
 		config.APIAddress = apiAddressEntry.Text
+		config.APIAddresses = nil
+		for _, address := range strings.Split(apiAddressesEntry.Text, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				config.APIAddresses = append(config.APIAddresses, address)
+			}
+		}
+		config.LoadBalancing = loadBalancingSelect.Selected
 		if n, err := fmt.Sscanf(tokenLimitEntry.Text, "%d", &config.TokenLimit); n != 1 || err != nil {
 			dialog.ShowError(fmt.Errorf("the wrong value of the maximum number of tokens"), window)
 			logger.Error("The wrong value of the maximum number of tokens")
@@ -188,6 +269,37 @@ func startGUI() {
 			return
 		}
 
+		if n, err := fmt.Sscanf(concurrencyEntry.Text, "%d", &config.MaxConcurrentRequests); n != 1 || err != nil || config.MaxConcurrentRequests < 1 {
+			dialog.ShowError(fmt.Errorf("the wrong value of the number of simultaneous requests"), window)
+			logger.Error("The wrong value of the number of simultaneous requests")
+			return
+		}
+
+		allowedGroups, err := parseChatIDs(allowedGroupsEntry.Text)
+		if err != nil {
+			dialog.ShowError(err, window)
+			logger.Errorf("The wrong list of allowed groups: %v", err)
+			return
+		}
+		deniedGroups, err := parseChatIDs(deniedGroupsEntry.Text)
+		if err != nil {
+			dialog.ShowError(err, window)
+			logger.Errorf("The wrong list of denied groups: %v", err)
+			return
+		}
+		config.AllowedGroups = allowedGroups
+		config.DeniedGroups = deniedGroups
+
+		sampling := config.SamplingParams
+		for i, param := range samplingParams {
+			if err := param.set(&sampling, strings.TrimSpace(samplingEntries[i].Text)); err != nil {
+				dialog.ShowError(err, window)
+				logger.Errorf("Invalid generation parameter: %v", err)
+				return
+			}
+		}
+		config.SamplingParams = sampling
+
 		config.BotToken = botTokenEntry.Text
 		config.UpdateMethod = updateMethodSelect.Selected
 		config.WebhookDomain = webhookDomainEntry.Text
@@ -196,6 +308,20 @@ func startGUI() {
 		config.KeyFile = keyFileEntry.Text
 		config.SystemRole = systemRoleEntry.Text
 		config.LMStudioMode = lmModeSelect.Selected
+		config.ReasoningMode = reasoningSelect.Selected
+		config.ConversationStore = conversationStoreSelect.Selected
+		config.Tokenizer = tokenizerSelect.Selected
+		config.TokenizerFile = tokenizerFileEntry.Text
+		config.STTAddress = strings.TrimSpace(sttAddressEntry.Text)
+		config.STTModel = strings.TrimSpace(sttModelEntry.Text)
+		config.ToolsDir = strings.TrimSpace(toolsDirEntry.Text)
+
+		config.Tools = nil
+		for _, name := range strings.Split(toolsEntry.Text, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				config.Tools = append(config.Tools, name)
+			}
+		}
 
 		if err := saveConfig(); err != nil {
 			dialog.ShowError(fmt.Errorf("configuration conservation error: %v", err), window)
@@ -203,16 +329,26 @@ func startGUI() {
 			return
 		}
 
+		initTokenizer()
+
 		dialog.ShowInformation(t("Success"), t("The configuration is saved!"), window)
 		logger.Info("The configuration is saved!")
 	})
 
+	generationForm := widget.NewForm()
+	for i, param := range samplingParams {
+		generationForm.Append(param.Name, samplingEntries[i])
+	}
+
 	configForm := container.NewVBox(
 		widget.NewLabelWithStyle(t("Configuration"), fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
 		widget.NewForm(
 			widget.NewFormItem(t("LM Studio API address"), apiAddressEntry),
-			widget.NewFormItem(t("Max. tokens"), tokenLimitEntry),
+			widget.NewFormItem(t("LM Studio hosts"), apiAddressesEntry),
+			widget.NewFormItem(t("Load balancing"), loadBalancingSelect),
+			widget.NewFormItem(t("Context size (tokens)"), tokenLimitEntry),
 			widget.NewFormItem(t("Timeout (sec)"), timeoutEntry),
+			widget.NewFormItem(t("Simultaneous requests"), concurrencyEntry),
 			widget.NewFormItem(t("Bot token"), botTokenEntry),
 			widget.NewFormItem(t("Update method"), updateMethodSelect),
 			widget.NewFormItem(t("Webhook domain"), webhookDomainEntry),
@@ -221,8 +357,20 @@ func startGUI() {
 			widget.NewFormItem(t("The path to Key.pem"), keyFileEntry),
 			widget.NewFormItem(t("System message"), systemRoleEntry),
 			widget.NewFormItem(t("LM Studio mode"), lmModeSelect),
+			widget.NewFormItem(t("Reasoning"), reasoningSelect),
+			widget.NewFormItem(t("Tokenizer"), tokenizerSelect),
+			widget.NewFormItem(t("Tokenizer file"), tokenizerFileEntry),
+			widget.NewFormItem(t("Conversation storage"), conversationStoreSelect),
+			widget.NewFormItem(t("Speech recognition address"), sttAddressEntry),
+			widget.NewFormItem(t("Speech recognition model"), sttModelEntry),
+			widget.NewFormItem(t("Tools"), toolsEntry),
+			widget.NewFormItem(t("Tool files folder"), toolsDirEntry),
+			widget.NewFormItem(t("Allowed groups"), allowedGroupsEntry),
+			widget.NewFormItem(t("Denied groups"), deniedGroupsEntry),
 			widget.NewFormItem(t("Language"), languageSelect),
 		),
+		widget.NewLabelWithStyle(t("Generation parameters"), fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		generationForm,
 		saveConfigButton,
 	)
 
@@ -232,11 +380,23 @@ func startGUI() {
 	modelSelect := widget.NewSelect([]string{}, func(val string) {
 		selectedModel = val
 		logger.Infof("Selected model: %s", selectedModel)
+
+		// We remember the model for the next launch (including the launch without GUI)
+		if config.Model != val {
+			config.Model = val
+			if err := saveConfig(); err != nil {
+				logger.Errorf("Configuration conservation error: %v", err)
+			}
+		}
 	})
 	modelSelect.PlaceHolder = t("Select a model")
+	if selectedModel != "" {
+		modelSelect.Options = []string{selectedModel}
+		modelSelect.SetSelected(selectedModel)
+	}
 
 	refreshModelsButton := widget.NewButtonWithIcon(t("Update models"), theme.ViewRefreshIcon(), func() {
-		models, err := fetchModels()
+		models, err := fetchModels(context.Background())
 		if err != nil {
 			dialog.ShowError(fmt.Errorf("error getting models: %v", err), window)
 			logger.Errorf("Error getting models: %v", err)
@@ -269,32 +429,50 @@ func startGUI() {
 
 		rows := []fyne.CanvasObject{
 			container.NewHBox(
-				widget.NewLabelWithStyle(t("Allowed"), fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+				widget.NewLabelWithStyle(t("Role"), fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
 				widget.NewLabelWithStyle(t("ID"), fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
 				widget.NewLabelWithStyle(t("Username"), fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+				widget.NewLabelWithStyle(t("Allowed models"), fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
 			),
 		}
 
 		for _, u := range getSortedUsers() {
 			uid := u.ID // Local copy to close
-			allowedCheck := widget.NewCheck("", func(val bool) {
-				usersMutex.Lock()
-				if user, ok := users[uid]; ok {
-					user.Allowed = val
+			roleSelect := widget.NewSelect(roles, nil)
+			roleSelect.SetSelected(u.Role)
+			roleSelect.OnChanged = func(val string) {
+				setUserRole(uid, val)
+
+				if err := saveUsers(); err != nil {
+					dialog.ShowError(fmt.Errorf("error saving users: %v", err), window)
+					logger.Errorf("Error saving users: %v", err)
+				}
+			}
+
+			// Models allowed to the user, separated by commas (empty - any model)
+			modelsEntry := widget.NewEntry()
+			modelsEntry.SetText(strings.Join(u.AllowedModels, ", "))
+			modelsEntry.SetPlaceHolder(t("Any model"))
+			modelsEntry.OnSubmitted = func(val string) {
+				var models []string
+				for _, m := range strings.Split(val, ",") {
+					if m = strings.TrimSpace(m); m != "" {
+						models = append(models, m)
+					}
 				}
-				usersMutex.Unlock()
+				setUserAllowedModels(uid, models)
 
 				if err := saveUsers(); err != nil {
 					dialog.ShowError(fmt.Errorf("error saving users: %v", err), window)
 					logger.Errorf("Error saving users: %v", err)
 				}
-			})
+			}
 
-			allowedCheck.SetChecked(u.Allowed)
 			row := container.NewHBox(
-				allowedCheck,
+				container.NewGridWrap(fyne.NewSize(120, roleSelect.MinSize().Height), roleSelect),
 				widget.NewLabel(fmt.Sprintf("%d", u.ID)),
 				widget.NewLabel(u.Username),
+				container.NewGridWrap(fyne.NewSize(300, modelsEntry.MinSize().Height), modelsEntry),
 			)
 			rows = append(rows, row)
 		}
@@ -319,6 +497,98 @@ func startGUI() {
 
 	refreshUsersTable()
 
+	// --------------------------
+	// Tab "Knowledge"
+	// --------------------------
+	knowledgeDirEntry := widget.NewEntry()
+	knowledgeDirEntry.SetText(config.KnowledgeDir)
+	knowledgeDirEntry.SetPlaceHolder("knowledge")
+
+	embeddingModelEntry := widget.NewEntry()
+	embeddingModelEntry.SetText(config.EmbeddingModel)
+	embeddingModelEntry.SetPlaceHolder("text-embedding-nomic-embed-text-v1.5")
+
+	topKEntry := widget.NewEntry()
+	topKEntry.SetText(fmt.Sprintf("%d", config.KnowledgeTopK))
+
+	minScoreEntry := widget.NewEntry()
+	minScoreEntry.SetText(fmt.Sprintf("%.2f", config.KnowledgeMinScore))
+
+	knowledgeStatusLabel := widget.NewLabel("")
+	showKnowledgeStats := func() {
+		files, chunks := knowledgeStats()
+		knowledgeStatusLabel.SetText(t("Indexed: %d files, %d fragments", files, chunks))
+	}
+	showKnowledgeStats()
+
+	saveKnowledgeSettings := func() bool {
+		if n, err := fmt.Sscanf(topKEntry.Text, "%d", &config.KnowledgeTopK); n != 1 || err != nil || config.KnowledgeTopK < 1 {
+			dialog.ShowError(fmt.Errorf("the wrong number of fragments"), window)
+			logger.Error("The wrong number of fragments")
+			return false
+		}
+		if n, err := fmt.Sscanf(minScoreEntry.Text, "%f", &config.KnowledgeMinScore); n != 1 || err != nil {
+			dialog.ShowError(fmt.Errorf("the wrong minimum similarity"), window)
+			logger.Error("The wrong minimum similarity")
+			return false
+		}
+		config.KnowledgeDir = strings.TrimSpace(knowledgeDirEntry.Text)
+		config.EmbeddingModel = strings.TrimSpace(embeddingModelEntry.Text)
+
+		if err := saveConfig(); err != nil {
+			dialog.ShowError(fmt.Errorf("configuration conservation error: %v", err), window)
+			logger.Errorf("Configuration conservation error: %v", err)
+			return false
+		}
+		return true
+	}
+
+	var updateIndexButton, rebuildIndexButton *widget.Button
+	runIndexing := func(full bool) {
+		if !saveKnowledgeSettings() {
+			return
+		}
+
+		updateIndexButton.Disable()
+		rebuildIndexButton.Disable()
+		knowledgeStatusLabel.SetText(t("Indexing..."))
+
+		go func() {
+			err := reindexKnowledge(context.Background(), full)
+			if err != nil {
+				logger.Errorf("Knowledge indexing error: %v", err)
+				dialog.ShowError(fmt.Errorf("indexing error: %v", err), window)
+			}
+			showKnowledgeStats()
+			updateIndexButton.Enable()
+			rebuildIndexButton.Enable()
+		}()
+	}
+
+	updateIndexButton = widget.NewButtonWithIcon(t("Update index"), theme.ViewRefreshIcon(), func() {
+		runIndexing(false)
+	})
+	rebuildIndexButton = widget.NewButtonWithIcon(t("Rebuild index"), theme.MediaReplayIcon(), func() {
+		runIndexing(true)
+	})
+	saveKnowledgeButton := widget.NewButtonWithIcon(t("Save the configuration"), theme.DocumentSaveIcon(), func() {
+		if saveKnowledgeSettings() {
+			dialog.ShowInformation(t("Success"), t("The configuration is saved!"), window)
+		}
+	})
+
+	knowledgeContainer := container.NewVBox(
+		widget.NewForm(
+			widget.NewFormItem(t("Knowledge folder"), knowledgeDirEntry),
+			widget.NewFormItem(t("Embedding model"), embeddingModelEntry),
+			widget.NewFormItem(t("Fragments per request"), topKEntry),
+			widget.NewFormItem(t("Minimum similarity"), minScoreEntry),
+		),
+		saveKnowledgeButton,
+		knowledgeStatusLabel,
+		container.NewHBox(updateIndexButton, rebuildIndexButton),
+	)
+
 	// --------------------------
 	// Basic layout via TabContainer
 	// --------------------------
@@ -326,6 +596,7 @@ func startGUI() {
 		container.NewTabItemWithIcon(t("Configuration"), theme.SettingsIcon(), container.NewVScroll(configForm)),
 		container.NewTabItemWithIcon(t("Models"), theme.ComputerIcon(), container.NewVScroll(modelsContainer)),
 		container.NewTabItemWithIcon(t("Users"), theme.AccountIcon(), container.NewVScroll(usersContainer)),
+		container.NewTabItemWithIcon(t("Knowledge"), theme.FolderIcon(), container.NewVScroll(knowledgeContainer)),
 		container.NewTabItemWithIcon(t("Bot"), theme.MediaPlayIcon(), botTabContent()),
 	)
 	tabs.SetTabLocation(container.TabLocationTop)
@@ -0,0 +1,11 @@
+//go:build headless
+
+package main
+
+// The program is built without the GUI (go build -tags headless): fyne and the graphics libraries
+// are not linked, the bot always works in daemon mode
+const guiAvailable = false
+
+func startGUI() {
+	logger.Fatal("The program is built without GUI")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Launch of the bot without GUI: works until SIGINT/SIGTERM is received
+func runHeadless() {
+	if selectedModel == "" {
+		logger.Warn("The model is not set in the configuration, the first available model will be used")
+		models, err := fetchModels(context.Background())
+		if err != nil {
+			logger.Fatalf("Error getting models: %v", err)
+		}
+		if len(models) == 0 {
+			logger.Fatal("LM Studio has no available models")
+		}
+		selectedModel = models[0]
+	}
+	logger.Infof("Selected model: %s", selectedModel)
+
+	stopChan := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		startUpdates(stopChan)
+		close(stopped)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case sig := <-signals:
+		logger.Infof("Signal received: %v, stopping the bot...", sig)
+	case <-stopped:
+		logger.Warn("Receiving updates has stopped, shutting down...")
+	}
+
+	signal.Stop(signals)
+	close(stopChan)
+	<-stopped
+
+	if !waitActiveUpdates(shutdownTimeout) {
+		logger.Warn("Not all updates were processed before shutdown")
+	}
+
+	logger.Info("The bot is stopped")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	balanceRoundRobin = "round_robin"
+	balanceLeastBusy  = "least_busy"
+
+	healthCheckTimeout = 10 * time.Second
+)
+
+// hostState The state of a server address known from the health checks and the requests
+type hostState struct {
+	healthy bool
+	checked bool            // The models of the host are known
+	models  map[string]bool // Models served by the host
+	active  int             // Requests being executed
+}
+
+// hostKey An address of a backend: backends sharing one server keep separate states,
+// because each of them serves its own models and counts its own requests
+type hostKey struct {
+	backend string
+	address string
+}
+
+var (
+	hostStates = make(map[hostKey]*hostState)
+	// The counter of the round-robin distribution for each backend
+	roundRobin = make(map[string]int)
+	hostsMutex sync.Mutex
+)
+
+// hostPool Addresses of the hosts of one backend
+type hostPool struct {
+	name      string
+	addresses []string
+	apiKey    string
+}
+
+// The state of the address of the backend (new addresses are considered healthy until the first failure)
+func (p *hostPool) stateLocked(address string) *hostState {
+	key := hostKey{backend: p.name, address: address}
+	s, ok := hostStates[key]
+	if !ok {
+		s = &hostState{healthy: true}
+		hostStates[key] = s
+	}
+	return s
+}
+
+// Marking the address as healthy or failed; the changes are logged
+func (p *hostPool) setHealth(address string, healthy bool, reason error) {
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+
+	s := p.stateLocked(address)
+	if s.healthy != healthy {
+		if healthy {
+			logger.Infof("The host %s of the backend %s is available again", address, p.name)
+		} else {
+			logger.Warnf("The host %s of the backend %s is unavailable: %v", address, p.name, reason)
+		}
+	}
+	s.healthy = healthy
+}
+
+// Saving the models of the address received by /models
+func (p *hostPool) setModels(address string, models []string) {
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+
+	s := p.stateLocked(address)
+	s.checked = true
+	s.models = make(map[string]bool)
+	for _, m := range models {
+		s.models[m] = true
+	}
+}
+
+// The order of the addresses for the request of the model: first the healthy hosts serving the model
+// (by the balancing mode), then the other healthy hosts and last the failed ones
+func (p *hostPool) candidates(model string) []string {
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+
+	var serving, other, failed []string
+	for _, address := range p.addresses {
+		s := p.stateLocked(address)
+		switch {
+		case !s.healthy:
+			failed = append(failed, address)
+		case model == "" || !s.checked || s.models[model]:
+			serving = append(serving, address)
+		default:
+			other = append(other, address)
+		}
+	}
+
+	if n := len(serving); n > 1 {
+		// Rotation spreads the requests evenly and breaks ties between equally busy hosts
+		start := roundRobin[p.name] % n
+		roundRobin[p.name]++
+		serving = append(append([]string{}, serving[start:]...), serving[:start]...)
+
+		if config.LoadBalancing == balanceLeastBusy {
+			sort.SliceStable(serving, func(i, j int) bool {
+				return p.stateLocked(serving[i]).active < p.stateLocked(serving[j]).active
+			})
+		}
+	}
+
+	return append(append(serving, other...), failed...)
+}
+
+// Counting the request being executed on the address
+func (p *hostPool) acquire(address string) func() {
+	hostsMutex.Lock()
+	p.stateLocked(address).active++
+	hostsMutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			hostsMutex.Lock()
+			p.stateLocked(address).active--
+			hostsMutex.Unlock()
+		})
+	}
+}
+
+// Sending the request to the hosts of the backend one after another until one of them answers.
+// The returned function must be called when the response is read (the host stops being busy).
+func (p *hostPool) request(ctx context.Context, method, path, model string, body any) (*http.Response, func(), error) {
+	addresses := p.candidates(model)
+	if len(addresses) == 0 {
+		return nil, nil, fmt.Errorf("the backend %s has no addresses", p.name)
+	}
+
+	var lastErr error
+	for i, address := range addresses {
+		release := p.acquire(address)
+		resp, err := doJSONRequest(ctx, method, strings.TrimRight(address, "/")+path, p.apiKey, body)
+		if err == nil {
+			p.setHealth(address, true, nil)
+			return resp, release, nil
+		}
+		release()
+
+		// The stopped generation is not repeated on other hosts
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+
+		lastErr = err
+		var statusErr *statusError
+		if !errors.As(err, &statusErr) || statusErr.code >= http.StatusInternalServerError {
+			p.setHealth(address, false, err)
+		}
+		if i < len(addresses)-1 {
+			logger.Warnf("Request to %s failed (%v), trying the next host", address, err)
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// Requesting the models of every host of the backend; the result is the union of the lists
+func (p *hostPool) models(ctx context.Context, path string, parse func(resp *http.Response) ([]string, error)) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	var lastErr error
+	available := 0
+
+	for _, address := range p.addresses {
+		resp, err := doJSONRequest(ctx, http.MethodGet, strings.TrimRight(address, "/")+path, p.apiKey, nil)
+		if err == nil {
+			var models []string
+			models, err = parse(resp)
+			closeBody(resp.Body)
+			if err == nil {
+				p.setHealth(address, true, nil)
+				p.setModels(address, models)
+				available++
+				for _, m := range models {
+					if !seen[m] {
+						seen[m] = true
+						result = append(result, m)
+					}
+				}
+				continue
+			}
+		}
+
+		lastErr = err
+		p.setHealth(address, false, err)
+	}
+
+	if available == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return result, nil
+}
+
+// Addresses of the backend: the list of addresses or the single address
+func backendAddresses(address string, addresses []string) []string {
+	var result []string
+	for _, a := range addresses {
+		if a = strings.TrimSpace(a); a != "" {
+			result = append(result, a)
+		}
+	}
+	if len(result) == 0 && address != "" {
+		result = []string{address}
+	}
+	return result
+}
+
+// Periodic checks of the hosts of all backends via the list of models, until stop is closed
+func runHealthChecks(stop <-chan struct{}) {
+	for {
+		interval := time.Duration(config.HealthCheckInterval) * time.Second
+		if interval <= 0 {
+			return
+		}
+
+		for _, b := range configuredBackends() {
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			if _, err := b.Models(ctx); err != nil {
+				logger.Debugf("Health check of the backend %s: %v", b.Name(), err)
+			}
+			cancel()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
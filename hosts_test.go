@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestHostStatesOfBackendsSharingAnAddress(t *testing.T) {
+	saved := hostStates
+	t.Cleanup(func() { hostStates = saved })
+	hostStates = make(map[hostKey]*hostState)
+
+	addresses := []string{"http://shared:1234", "http://other:1234"}
+	lmstudio := &hostPool{name: "lmstudio", addresses: addresses}
+	ollama := &hostPool{name: "ollama", addresses: addresses}
+
+	lmstudio.setHealth(addresses[0], false, errors.New("connection refused"))
+	ollama.setModels(addresses[0], []string{"llama3"})
+	ollama.setModels(addresses[1], []string{"mistral"})
+
+	if got := lmstudio.candidates(""); got[len(got)-1] != addresses[0] {
+		t.Errorf("the failed host of lmstudio must be the last one: %v", got)
+	}
+	if got := ollama.candidates("llama3"); !slices.Equal(got, addresses) {
+		t.Errorf("the failure of lmstudio must not affect ollama: %v", got)
+	}
+	// The models of ollama are not the models of lmstudio at the same address
+	if got := lmstudio.candidates("llama3"); !slices.Equal(got, []string{addresses[1], addresses[0]}) {
+		t.Errorf("lmstudio candidates = %v", got)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Telegram gives bots files up to 20 MB
+	maxImageSize    = 20 * 1024 * 1024
+	downloadTimeout = 60 * time.Second
+)
+
+// imageRef An image attached to a Telegram message
+type imageRef struct {
+	FileID   string
+	MimeType string
+}
+
+// The image of the message: the largest size of a photo or a document with an image
+func messageImage(message *tgbotapi.Message) (imageRef, bool) {
+	if len(message.Photo) > 0 {
+		photo := message.Photo[len(message.Photo)-1]
+		return imageRef{FileID: photo.FileID, MimeType: "image/jpeg"}, true
+	}
+
+	if doc := message.Document; doc != nil && strings.HasPrefix(doc.MimeType, "image/") {
+		return imageRef{FileID: doc.FileID, MimeType: doc.MimeType}, true
+	}
+
+	return imageRef{}, false
+}
+
+// The image in the history of the conversation: the file of Telegram instead of its data,
+// the image is downloaded again only for the request of its turn
+const telegramImagePrefix = "telegram:"
+
+// The reference to the image of Telegram for the history
+func (ref imageRef) historyURL() string {
+	return telegramImagePrefix + ref.MimeType + ":" + ref.FileID
+}
+
+// The image of the history by its reference (false for data URLs of older histories)
+func parseHistoryImage(url string) (imageRef, bool) {
+	rest, ok := strings.CutPrefix(url, telegramImagePrefix)
+	if !ok {
+		return imageRef{}, false
+	}
+	mimeType, fileID, ok := strings.Cut(rest, ":")
+	return imageRef{FileID: fileID, MimeType: mimeType}, ok
+}
+
+// The history for the request: only the last message of the user keeps its images,
+// the images of the earlier messages are replaced with a note
+func withoutOldImages(msgs []LMMessage) []LMMessage {
+	last := -1
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			last = i
+			break
+		}
+	}
+
+	result := make([]LMMessage, len(msgs))
+	for i, m := range msgs {
+		if len(m.Images) > 0 && i != last {
+			m.Content = strings.TrimSpace(m.Content + "\n[image]")
+			m.Images = nil
+		}
+		result[i] = m
+	}
+	return result
+}
+
+// Downloading the images of the request referred to by the history
+func downloadHistoryImages(msgs []LMMessage) error {
+	for i, m := range msgs {
+		if len(m.Images) == 0 {
+			continue
+		}
+		images := make([]string, len(m.Images))
+		for j, url := range m.Images {
+			images[j] = url
+			if ref, ok := parseHistoryImage(url); ok {
+				dataURL, err := downloadImage(ref)
+				if err != nil {
+					return err
+				}
+				images[j] = dataURL
+			}
+		}
+		msgs[i].Images = images
+	}
+	return nil
+}
+
+// Downloading the image from Telegram as a data URL for the model
+func downloadImage(ref imageRef) (string, error) {
+	data, err := downloadTelegramFile(ref.FileID, maxImageSize)
+	if err != nil {
+		return "", err
+	}
+
+	mimeType := ref.MimeType
+	if detected := http.DetectContentType(data); strings.HasPrefix(detected, "image/") {
+		mimeType = detected
+	}
+
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// Downloading a file sent to the bot (no more than maxSize bytes)
+func downloadTelegramFile(fileID string, maxSize int64) ([]byte, error) {
+	fileURL, err := bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: downloadTimeout}
+	resp, err := client.Get(fileURL)
+	if err != nil {
+		// The address in the error contains the token of the bot
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return nil, fmt.Errorf("file download error: %v", urlErr.Err)
+		}
+		return nil, errors.New("file download error")
+	}
+
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logger.Errorf("Error closing response: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("the file is larger than %d bytes", maxSize)
+	}
+
+	return data, nil
+}
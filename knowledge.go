@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Size of a fragment of a knowledge file
+	knowledgeChunkTokens = 384
+	// How many fragments are sent to /embeddings in one request
+	embeddingBatchSize = 16
+)
+
+// Files of the knowledge folder that are indexed
+var knowledgeExtensions = map[string]bool{".md": true, ".markdown": true, ".txt": true}
+
+// KnowledgeChunk A fragment of a knowledge file with its embedding
+type KnowledgeChunk struct {
+	Source string    `json:"source"` // Path of the file relative to the knowledge folder
+	Text   string    `json:"text"`
+	Vector []float32 `json:"vector"` // Normalized embedding
+}
+
+// KnowledgeFile The state of an indexed file (changed files are indexed again)
+type KnowledgeFile struct {
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+}
+
+// KnowledgeIndex The on-disk index of the knowledge folder
+type KnowledgeIndex struct {
+	Model   string                   `json:"model"`
+	Dir     string                   `json:"dir"`
+	Files   map[string]KnowledgeFile `json:"files"`
+	Chunks  []KnowledgeChunk         `json:"chunks"`
+	Updated time.Time                `json:"updated"`
+}
+
+// KnowledgeResult A fragment found for the query
+type KnowledgeResult struct {
+	KnowledgeChunk
+	Score float32
+}
+
+// Requests and answers of the /embeddings endpoint
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type EmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+var (
+	knowledgeIndex = &KnowledgeIndex{Files: make(map[string]KnowledgeFile)}
+	knowledgeMutex sync.RWMutex
+	// Only one indexing at a time
+	indexingMutex sync.Mutex
+
+	errIndexingInProgress = errors.New("indexing is already in progress")
+)
+
+// The knowledge base is used if the folder and the embedding model are set
+func knowledgeEnabled() bool {
+	return config.KnowledgeDir != "" && config.EmbeddingModel != ""
+}
+
+// The file of the index
+func knowledgeIndexFileName() string {
+	if config.KnowledgeIndex != "" {
+		return config.KnowledgeIndex
+	}
+	return "knowledge_index.json"
+}
+
+// Loading the index from the file
+func loadKnowledgeIndex() error {
+	data, err := os.ReadFile(knowledgeIndexFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	index := &KnowledgeIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return err
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]KnowledgeFile)
+	}
+
+	knowledgeMutex.Lock()
+	knowledgeIndex = index
+	knowledgeMutex.Unlock()
+
+	return nil
+}
+
+// Saving the index to the file
+func saveKnowledgeIndex(index *KnowledgeIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(knowledgeIndexFileName(), data, 0644)
+}
+
+// Number of indexed files and fragments
+func knowledgeStats() (files, chunks int) {
+	knowledgeMutex.RLock()
+	defer knowledgeMutex.RUnlock()
+
+	return len(knowledgeIndex.Files), len(knowledgeIndex.Chunks)
+}
+
+// Indexing of the knowledge folder. Only new and changed files are embedded,
+// unless full is set or the embedding model or the folder has changed.
+func reindexKnowledge(ctx context.Context, full bool) error {
+	if !indexingMutex.TryLock() {
+		return errIndexingInProgress
+	}
+	defer indexingMutex.Unlock()
+
+	if !knowledgeEnabled() {
+		return errors.New("the knowledge folder or the embedding model is not set")
+	}
+
+	knowledgeMutex.RLock()
+	previous := knowledgeIndex
+	knowledgeMutex.RUnlock()
+
+	dir := filepath.Clean(config.KnowledgeDir)
+	full = full || previous.Model != config.EmbeddingModel || previous.Dir != dir
+
+	// Fragments of unchanged files are taken from the previous index
+	reused := make(map[string][]KnowledgeChunk)
+	if !full {
+		for _, chunk := range previous.Chunks {
+			reused[chunk.Source] = append(reused[chunk.Source], chunk)
+		}
+	}
+
+	index := &KnowledgeIndex{
+		Model: config.EmbeddingModel,
+		Dir:   dir,
+		Files: make(map[string]KnowledgeFile),
+	}
+
+	var pending []KnowledgeChunk
+	embedded := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !knowledgeExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		source, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		source = filepath.ToSlash(source)
+		state := KnowledgeFile{ModTime: info.ModTime(), Size: info.Size()}
+		index.Files[source] = state
+
+		if old, ok := previous.Files[source]; ok && !full && old.ModTime.Equal(state.ModTime) && old.Size == state.Size {
+			index.Chunks = append(index.Chunks, reused[source]...)
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		text, err := extractDocumentText(path, "", data)
+		if err != nil {
+			logger.Warnf("Knowledge file %s is skipped: %v", source, err)
+			return nil
+		}
+
+		for _, part := range chunkText(text, knowledgeChunkTokens) {
+			pending = append(pending, KnowledgeChunk{Source: source, Text: part})
+		}
+		embedded++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(pending); start += embeddingBatchSize {
+		batch := pending[start:min(start+embeddingBatchSize, len(pending))]
+		inputs := make([]string, len(batch))
+		for i, chunk := range batch {
+			inputs[i] = chunk.Source + "\n\n" + chunk.Text
+		}
+
+		vectors, err := callEmbeddings(ctx, config.EmbeddingModel, inputs)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			batch[i].Vector = vectors[i]
+		}
+	}
+	index.Chunks = append(index.Chunks, pending...)
+	index.Updated = time.Now()
+
+	if err := saveKnowledgeIndex(index); err != nil {
+		return err
+	}
+
+	knowledgeMutex.Lock()
+	knowledgeIndex = index
+	knowledgeMutex.Unlock()
+
+	logger.Infof("Knowledge index is updated: %d files (%d embedded), %d fragments", len(index.Files), embedded, len(index.Chunks))
+	return nil
+}
+
+// The fragments of the knowledge base closest to the query
+func searchKnowledge(ctx context.Context, query string) ([]KnowledgeResult, error) {
+	knowledgeMutex.RLock()
+	index := knowledgeIndex
+	knowledgeMutex.RUnlock()
+
+	if !knowledgeEnabled() || len(index.Chunks) == 0 || strings.TrimSpace(query) == "" {
+		return nil, nil
+	}
+	if index.Model != config.EmbeddingModel {
+		return nil, errors.New("the knowledge index was built with another embedding model, it must be rebuilt")
+	}
+
+	vectors, err := callEmbeddings(ctx, index.Model, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	queryVector := vectors[0]
+
+	var results []KnowledgeResult
+	for _, chunk := range index.Chunks {
+		score := dotProduct(queryVector, chunk.Vector)
+		if float64(score) >= config.KnowledgeMinScore {
+			results = append(results, KnowledgeResult{KnowledgeChunk: chunk, Score: score})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+
+	topK := config.KnowledgeTopK
+	if topK <= 0 {
+		topK = 4
+	}
+	if len(results) > topK {
+		results = results[:topK]
+	}
+	return results, nil
+}
+
+// The found fragments for the system message; the model is asked to cite the sources by numbers
+func knowledgeContext(results []KnowledgeResult) string {
+	if len(results) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Answer using the following excerpts from the knowledge base when they are relevant. ")
+	sb.WriteString("Cite the excerpts you use by their numbers in square brackets, for example [1].\n\n")
+	for i, result := range knowledgeSources(results) {
+		for _, r := range results {
+			if r.Source == result {
+				sb.WriteString(fmt.Sprintf("[%d] %s\n\"\"\"\n%s\n\"\"\"\n\n", i+1, r.Source, r.Text))
+			}
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// Source files of the found fragments without repetitions (the numbers of the sources follow this order)
+func knowledgeSources(results []KnowledgeResult) []string {
+	seen := make(map[string]bool)
+	var sources []string
+	for _, r := range results {
+		if !seen[r.Source] {
+			seen[r.Source] = true
+			sources = append(sources, r.Source)
+		}
+	}
+	return sources
+}
+
+// The list of the sources under the answer
+func sourcesFooter(results []KnowledgeResult) string {
+	sources := knowledgeSources(results)
+	if len(sources) == 0 {
+		return ""
+	}
+
+	var lines []string
+	for i, source := range sources {
+		lines = append(lines, fmt.Sprintf("[%d] `%s`", i+1, source))
+	}
+	return sourcesMarker + t("Sources:") + "\n" + strings.Join(lines, "\n")
+}
+
+// The beginning of the list of the sources under the answer
+const sourcesMarker = "\n\n📚 "
+
+// The answer without the list of the sources (it is not kept in the context of the chat)
+func stripSources(text string) string {
+	if i := strings.LastIndex(text, sourcesMarker); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
+
+// Search in the knowledge base for the last message of the user of the chat
+func retrieveKnowledge(ctx context.Context, key conversationKey) []KnowledgeResult {
+	if !knowledgeEnabled() {
+		return nil
+	}
+
+	ctxMutex.Lock()
+	query := lastUserMessage(loadConversation(key))
+	ctxMutex.Unlock()
+
+	results, err := searchKnowledge(ctx, query)
+	if err != nil {
+		logger.Errorf("Knowledge search error: %v", err)
+		return nil
+	}
+	return results
+}
+
+// Calling the embedding model on its backend, the vectors are normalized
+func callEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	backend, name, err := resolveModel(model)
+	if err != nil {
+		return nil, err
+	}
+
+	vectors, err := backend.Embeddings(ctx, name, inputs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vectors {
+		vectors[i] = normalizeVector(vectors[i])
+	}
+	return vectors, nil
+}
+
+// Vector of unit length (the cosine similarity becomes the dot product)
+func normalizeVector(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+
+	norm := float32(math.Sqrt(sum))
+	result := make([]float32, len(v))
+	for i, x := range v {
+		result[i] = x / norm
+	}
+	return result
+}
+
+// Dot product of the vectors (0 if the sizes differ)
+func dotProduct(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// The /reindex command (administrators only): "/reindex [full]" updates the index of the knowledge folder
+func reindexCommand(message *tgbotapi.Message) string {
+	if !isAdmin(message.From.ID) {
+		return t("This command is available only to administrators.")
+	}
+	if !knowledgeEnabled() {
+		return t("The knowledge base is not configured: set the knowledge folder and the embedding model.")
+	}
+
+	key := promptConversation(message)
+	full := strings.TrimSpace(message.CommandArguments()) == "full"
+	go func() {
+		text := ""
+		if err := reindexKnowledge(context.Background(), full); err != nil {
+			logger.Errorf("Knowledge indexing error: %v", err)
+			text = t("Indexing error: %v", err)
+		} else {
+			files, chunks := knowledgeStats()
+			text = t("The knowledge index is updated: %d files, %d fragments.", files, chunks)
+		}
+		_, _ = sendTo(key, tgbotapi.NewMessage(key.ChatID, text))
+	}()
+
+	return t("Indexing of the knowledge folder has started...")
+}
@@ -2,15 +2,13 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
 	"time"
-
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 const (
@@ -20,17 +18,143 @@ const (
 type LMRequest struct {
 	Model    string      `json:"model"`
 	Messages []LMMessage `json:"messages"`
+	Tools    []LMTool    `json:"tools,omitempty"`
+	SamplingParams
 }
 
 type LMRequestStream struct {
-	Model    string      `json:"model"`
-	Messages []LMMessage `json:"messages"`
-	Stream   bool        `json:"stream"`
+	Model         string           `json:"model"`
+	Messages      []LMMessage      `json:"messages"`
+	Tools         []LMTool         `json:"tools,omitempty"`
+	Stream        bool             `json:"stream"`
+	StreamOptions *LMStreamOptions `json:"stream_options,omitempty"`
+	SamplingParams
+}
+
+type LMStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type LMMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Images of the message as data URLs; such a message is sent as multi-part content
+	Images []string `json:"-"`
+	// Calls of tools requested by the model (role "assistant")
+	ToolCalls []LMToolCall `json:"-"`
+	// The call whose result the message contains (role "tool")
+	ToolCallID string `json:"-"`
+}
+
+// LMContentPart A part of the multi-part content of a message (OpenAI format)
+type LMContentPart struct {
+	Type     string      `json:"type"` // "text" or "image_url"
+	Text     string      `json:"text,omitempty"`
+	ImageURL *LMImageURL `json:"image_url,omitempty"`
+}
+
+type LMImageURL struct {
+	URL string `json:"url"`
+}
+
+// LMToolCall A call of a tool requested by the model
+type LMToolCall struct {
+	ID       string         `json:"id"`
+	Type     string         `json:"type"` // "function"
+	Function LMFunctionCall `json:"function"`
+}
+
+type LMFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON object of the arguments
+}
+
+// LMToolCallDelta A part of a tool call in a chunk of the stream (parts are joined by Index)
+type LMToolCallDelta struct {
+	Index    int            `json:"index"`
+	ID       string         `json:"id,omitempty"`
+	Type     string         `json:"type,omitempty"`
+	Function LMFunctionCall `json:"function"`
+}
+
+// LMTool Description of a tool for the model
+type LMTool struct {
+	Type     string        `json:"type"` // "function"
+	Function LMFunctionDef `json:"function"`
+}
+
+type LMFunctionDef struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"` // JSON schema of the arguments
+}
+
+// lmMessageJSON The message in the format of the API
+type lmMessageJSON struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content"`
+	ToolCalls  []LMToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+}
+
+// The content is a string for text messages and an array of parts for messages with images
+func (m LMMessage) MarshalJSON() ([]byte, error) {
+	var content any = m.Content
+	if len(m.Images) > 0 {
+		parts := make([]LMContentPart, 0, len(m.Images)+1)
+		if m.Content != "" {
+			parts = append(parts, LMContentPart{Type: "text", Text: m.Content})
+		}
+		for _, url := range m.Images {
+			parts = append(parts, LMContentPart{Type: "image_url", ImageURL: &LMImageURL{URL: url}})
+		}
+		content = parts
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(lmMessageJSON{
+		Role:       m.Role,
+		Content:    data,
+		ToolCalls:  m.ToolCalls,
+		ToolCallID: m.ToolCallID,
+	})
+}
+
+// Reading the content as a string or as an array of parts
+func (m *LMMessage) UnmarshalJSON(data []byte) error {
+	var raw lmMessageJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*m = LMMessage{Role: raw.Role, ToolCalls: raw.ToolCalls, ToolCallID: raw.ToolCallID}
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+	if raw.Content[0] == '"' {
+		return json.Unmarshal(raw.Content, &m.Content)
+	}
+
+	var parts []LMContentPart
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return err
+	}
+
+	var texts []string
+	for _, part := range parts {
+		switch {
+		case part.Type == "text":
+			texts = append(texts, part.Text)
+		case part.Type == "image_url" && part.ImageURL != nil:
+			m.Images = append(m.Images, part.ImageURL.URL)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
 }
 
 type LMChoice struct {
@@ -39,17 +163,28 @@ type LMChoice struct {
 }
 
 type LMResponse struct {
-	ID      string     `json:"id"`
-	Object  string     `json:"object"`
-	Created int        `json:"created"`
-	Model   string     `json:"model"`
-	Choices []LMChoice `json:"choices"`
-	Usage   struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
-	SystemFingerprint string `json:"system_fingerprint"`
+	ID                string     `json:"id"`
+	Object            string     `json:"object"`
+	Created           int        `json:"created"`
+	Model             string     `json:"model"`
+	Choices           []LMChoice `json:"choices"`
+	Usage             LMUsage    `json:"usage"`
+	SystemFingerprint string     `json:"system_fingerprint"`
+}
+
+type LMUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// The sum of the usage of several requests
+func (u LMUsage) add(other LMUsage) LMUsage {
+	return LMUsage{
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+		TotalTokens:      u.TotalTokens + other.TotalTokens,
+	}
 }
 
 type LMResponseChunk struct {
@@ -61,12 +196,15 @@ type LMResponseChunk struct {
 	Choices           []struct {
 		Index int `json:"index"`
 		Delta struct {
-			Role    string `json:"role,omitempty"`
-			Content string `json:"content,omitempty"`
+			Role      string            `json:"role,omitempty"`
+			Content   string            `json:"content,omitempty"`
+			ToolCalls []LMToolCallDelta `json:"tool_calls,omitempty"`
 		} `json:"delta"`
 		Logprobs     interface{} `json:"logprobs"`
 		FinishReason interface{} `json:"finish_reason"`
 	} `json:"choices"`
+	// Only in the last chunk, if stream_options.include_usage is requested
+	Usage *LMUsage `json:"usage,omitempty"`
 }
 
 type LMModelData struct {
@@ -80,131 +218,90 @@ type LMModelsResponse struct {
 	Object string        `json:"object"`
 }
 
-// Creating a request URL
-func createURL(path string) string {
-	return strings.TrimRight(config.APIAddress, "/") + path
+// openAIBackend LM Studio or another server with the OpenAI-compatible API
+type openAIBackend struct {
+	hostPool
 }
 
-// Getting a list of models from LM Studio
-func fetchModels() ([]string, error) {
-	url := createURL("/models")
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("request error: %v", err)
-	}
+func (b *openAIBackend) Name() string {
+	return b.name
+}
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			logger.Errorf("Error closing response: %v", err)
+// Getting a list of models from LM Studio (of all hosts of the backend)
+func (b *openAIBackend) Models(ctx context.Context) ([]string, error) {
+	return b.models(ctx, "/models", func(resp *http.Response) ([]string, error) {
+		var modelResponse LMModelsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&modelResponse); err != nil {
+			return nil, fmt.Errorf("error parsing response: %v", err)
 		}
-	}(resp.Body)
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid status code: %d", resp.StatusCode)
-	}
-
-	var modelResponse LMModelsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&modelResponse); err != nil {
-		return nil, fmt.Errorf("error parsing response: %v", err)
-	}
-
-	var models []string
-	for _, m := range modelResponse.Data {
-		models = append(models, m.ID)
-	}
-
-	return models, nil
+		var models []string
+		for _, m := range modelResponse.Data {
+			models = append(models, m.ID)
+		}
+		return models, nil
+	})
 }
 
-// Calling LM Studio (full answer)
-func callLMStudio(model string, conversation []LMMessage) (string, error) {
+// One request to /chat/completions without streaming
+func (b *openAIBackend) Chat(ctx context.Context, chat ChatRequest) (LMMessage, LMUsage, error) {
 	reqBody := LMRequest{
-		Model:    model,
-		Messages: conversation,
+		Model:          chat.Model,
+		Messages:       chat.Messages,
+		Tools:          chat.Tools,
+		SamplingParams: chat.Params,
 	}
 
-	data, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", err
-	}
-
-	url := createURL("/chat/completions")
-	client := &http.Client{Timeout: apiTimeout}
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(data))
-
-	if err != nil {
-		return "", fmt.Errorf("LM Studio request error: %v", err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			logger.Errorf("Error closing response: %v", err)
-		}
-	}(resp.Body)
-
-	body, err := io.ReadAll(resp.Body)
+	resp, release, err := b.request(ctx, http.MethodPost, "/chat/completions", chat.Model, reqBody)
 	if err != nil {
-		return "", err
+		return LMMessage{}, LMUsage{}, fmt.Errorf("LM Studio %v", err)
 	}
+	defer release()
+	defer closeBody(resp.Body)
 
 	var lmResp LMResponse
-	if err := json.Unmarshal(body, &lmResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+	if err := json.NewDecoder(resp.Body).Decode(&lmResp); err != nil {
+		return LMMessage{}, LMUsage{}, fmt.Errorf("error parsing response: %v", err)
 	}
 
 	if len(lmResp.Choices) == 0 {
-		return "", fmt.Errorf("no answers available")
+		return LMMessage{}, lmResp.Usage, fmt.Errorf("no answers available")
 	}
 
-	return lmResp.Choices[0].Message.Content, nil
+	return lmResp.Choices[0].Message, lmResp.Usage, nil
 }
 
-// Calling LM Studio in Streaming mode
-func callLMStudioStream(model string, conversation []LMMessage, chatID int64) (string, error) {
+// One streaming request to /chat/completions; the message with the full text and the joined tool calls is returned
+func (b *openAIBackend) ChatStream(ctx context.Context, chat ChatRequest, onStart func() error, onText func(text string)) (LMMessage, LMUsage, error) {
+	message := LMMessage{Role: "assistant"}
+	var usage LMUsage
 	reqBody := LMRequestStream{
-		Model:    model,
-		Messages: conversation,
-		Stream:   true,
+		Model:          chat.Model,
+		Messages:       chat.Messages,
+		Tools:          chat.Tools,
+		SamplingParams: chat.Params,
+		Stream:         true,
+		// We ask for usage in the last chunk to calibrate the token estimate
+		StreamOptions: &LMStreamOptions{IncludeUsage: true},
 	}
 
-	data, err := json.Marshal(reqBody)
+	resp, release, err := b.request(ctx, http.MethodPost, "/chat/completions", chat.Model, reqBody)
 	if err != nil {
-		return "", err
-	}
-
-	url := createURL("/chat/completions")
-	client := &http.Client{Timeout: apiTimeout}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("LM Studio request error: %v", err)
-	}
-
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			logger.Errorf("Error closing response: %v", err)
-		}
-	}(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("invalid status code: %d", resp.StatusCode)
+		return message, usage, fmt.Errorf("LM Studio %v", err)
 	}
+	defer release()
+	defer closeBody(resp.Body)
 
 	// We send the initial message that we will edit
-	initialMsg := tgbotapi.NewMessage(chatID, "...")
-	sentMsg, err := bot.Send(initialMsg)
-	if err != nil {
-		return "", fmt.Errorf("error sending message: %v", err)
+	if onStart != nil {
+		if err := onStart(); err != nil {
+			return message, usage, fmt.Errorf("error sending message: %v", err)
+		}
 	}
 
 	var fullResponse string
+	var toolCalls []LMToolCall
+	chunks := 0 // Chunks with text, if the server does not report the usage
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -226,18 +323,172 @@ func callLMStudioStream(model string, conversation []LMMessage, chatID int64) (s
 			continue
 		}
 
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+
 		if len(chunk.Choices) > 0 {
-			partial := chunk.Choices[0].Delta.Content
-			fullResponse += partial
-			edit := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, fullResponse)
-			edit.ParseMode = tgParseMode
-			_, _ = bot.Request(edit)
+			delta := chunk.Choices[0].Delta
+			toolCalls = mergeToolCallDeltas(toolCalls, delta.ToolCalls)
+			if delta.Content != "" {
+				fullResponse += delta.Content
+				chunks++
+				onText(fullResponse)
+			}
 		}
 	}
 
+	message.Content = fullResponse
+	message.ToolCalls = toolCalls
+	if usage.CompletionTokens == 0 {
+		usage.CompletionTokens = chunks
+	}
 	if err := scanner.Err(); err != nil {
-		return fullResponse, err
+		// The calls of the interrupted stream are incomplete
+		message.ToolCalls = nil
+		return message, usage, err
+	}
+
+	return message, usage, nil
+}
+
+// Calling the /embeddings endpoint
+func (b *openAIBackend) Embeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	resp, release, err := b.request(ctx, http.MethodPost, "/embeddings", model, EmbeddingRequest{Model: model, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("embeddings %v", err)
+	}
+	defer release()
+	defer closeBody(resp.Body)
+
+	var result EmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+	if len(result.Data) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(result.Data))
+	}
+
+	vectors := make([][]float32, len(inputs))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return nil, fmt.Errorf("invalid embedding index: %d", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	return vectors, nil
+}
+
+// Calling the model (full answer). The tools requested by the model are executed
+// and their results are sent back until the model gives the final answer.
+// The usage of all the rounds is summed up.
+func callLMStudio(ctx context.Context, model string, conversation []LMMessage, params SamplingParams) (string, LMUsage, error) {
+	var total LMUsage
+	backend, name, err := resolveModel(model)
+	if err != nil {
+		return "", total, err
+	}
+
+	req := ChatRequest{Model: name, Messages: conversation, Tools: enabledTools(), Params: params}
+	for round := 0; ; round++ {
+		message, usage, err := backend.Chat(ctx, req)
+		total = total.add(usage)
+		if err != nil {
+			return "", total, err
+		}
+		// prompt_tokens also counts the schemas of the tools, such requests would skew the calibration
+		if round == 0 && len(req.Tools) == 0 {
+			calibrateTokenizer(model, conversation, usage.PromptTokens)
+		}
+
+		if len(message.ToolCalls) == 0 {
+			return message.Content, total, nil
+		}
+		if round >= maxToolRounds {
+			return message.Content, total, errors.New("too many tool calls")
+		}
+
+		req.Messages = appendToolResults(ctx, req.Messages, message)
+	}
+}
+
+// Calling the model in Streaming mode (the answer being generated is shown by the renderer).
+// The stream can be stopped by ctx, then the partial answer is returned with the error.
+// The tools requested by the model are executed and the answer continues in the next stream.
+func callLMStudioStream(ctx context.Context, model string, conversation []LMMessage, params SamplingParams, renderer *streamRenderer) (string, LMUsage, error) {
+	var total LMUsage
+	backend, name, err := resolveModel(model)
+	if err != nil {
+		return "", total, err
+	}
+
+	req := ChatRequest{Model: name, Messages: conversation, Tools: enabledTools(), Params: params}
+	var shown string // The text of the previous rounds
+	for round := 0; ; round++ {
+		// The initial message is sent when the first stream starts
+		var onStart func() error
+		if round == 0 {
+			onStart = renderer.Start
+		}
+
+		message, usage, err := backend.ChatStream(ctx, req, onStart, func(text string) {
+			renderer.Update(joinAnswerParts(shown, text))
+		})
+		total = total.add(usage)
+		// prompt_tokens also counts the schemas of the tools, such requests would skew the calibration
+		if round == 0 && len(req.Tools) == 0 {
+			calibrateTokenizer(model, conversation, usage.PromptTokens)
+		}
+		shown = joinAnswerParts(shown, message.Content)
+		if err != nil {
+			return shown, total, err
+		}
+
+		if len(message.ToolCalls) == 0 {
+			return shown, total, nil
+		}
+		if round >= maxToolRounds {
+			return shown, total, errors.New("too many tool calls")
+		}
+
+		for _, call := range message.ToolCalls {
+			renderer.Update(joinAnswerParts(shown, "_"+t("🔧 Using the tool %s…", call.Function.Name)+"_"))
+		}
+		req.Messages = appendToolResults(ctx, req.Messages, message)
 	}
+}
 
-	return fullResponse, nil
+// Joining the texts of the answer from several rounds of tool calls
+func joinAnswerParts(previous, next string) string {
+	if strings.TrimSpace(previous) == "" {
+		return next
+	}
+	if strings.TrimSpace(next) == "" {
+		return previous
+	}
+	return strings.TrimRight(previous, "\n") + "\n\n" + next
+}
+
+// Joining the parts of the tool calls from the chunks of the stream
+func mergeToolCallDeltas(calls []LMToolCall, deltas []LMToolCallDelta) []LMToolCall {
+	for _, d := range deltas {
+		// A broken chunk must not panic or grow the list without limit
+		if d.Index < 0 || d.Index >= maxToolCalls {
+			logger.Warnf("Invalid tool call index in the stream: %d", d.Index)
+			continue
+		}
+		for len(calls) <= d.Index {
+			calls = append(calls, LMToolCall{Type: "function"})
+		}
+		call := &calls[d.Index]
+		if d.ID != "" {
+			call.ID = d.ID
+		}
+		if d.Type != "" {
+			call.Type = d.Type
+		}
+		call.Function.Name += d.Function.Name
+		call.Function.Arguments += d.Function.Arguments
+	}
+	return calls
 }
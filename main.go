@@ -1,36 +1,65 @@
 package main
 
 import (
+	"flag"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 const (
-	logLevel    = "debug"
-	logFile     = "app_log.json"
-	tgParseMode = "Markdown"
+	logLevel = "debug"
+	logFile  = "app_log.json"
 )
 
 var bot *tgbotapi.BotAPI
 var selectedModel string
 
 func main() {
+	headless := flag.Bool("headless", false, "run the bot without GUI (daemon mode)")
+	flag.Parse()
+
 	setupLogger()
 
 	logger.Info("Launch of the program ...")
 	initConfig()
 	logger.Info("The configuration is loaded")
 
+	selectedModel = config.Model
+
 	// We load the localization before starting
 	logger.Info("Loading localization...")
 	loadTranslations(config.Language)
 	logger.Info("Localization is loaded")
 
+	initTokenizer()
+
+	if err := initConversationStore(); err != nil {
+		logger.Fatalf("Conversation store initialization error: %v", err)
+	}
+	logger.Infof("Conversation store: %s", config.ConversationStore)
+
+	if err := loadKnowledgeIndex(); err != nil {
+		logger.Errorf("Error loading knowledge index: %v", err)
+	}
+
 	logger.Info("Users download...")
 	if err := loadUsers(); err != nil {
 		logger.Errorf("User download error: %v", err)
 	}
 	logger.Info("Users are successfully loaded")
 
+	if err := loadChatSettings(); err != nil {
+		logger.Errorf("Chat settings download error: %v", err)
+	}
+
+	if err := loadUsage(); err != nil {
+		logger.Errorf("Usage download error: %v", err)
+	}
+
+	if err := loadReplyChains(); err != nil {
+		logger.Errorf("Reply chains download error: %v", err)
+	}
+
 	var errTg error
 	bot, errTg = tgbotapi.NewBotAPI(config.BotToken)
 	if errTg != nil {
@@ -39,6 +68,19 @@ func main() {
 		logger.Infof("Authorized the bot: %s", bot.Self.UserName)
 	}
 
+	// The reply chains are saved with a delay, the last changes are saved on exit
+	defer flushReplyChains()
+
+	if *headless || config.Headless || !guiAvailable {
+		if errTg != nil {
+			logger.Fatal("The bot cannot be launched without GUI: Telegram bot is not created")
+		}
+
+		logger.Info("Headless launch...")
+		runHeadless()
+		return
+	}
+
 	logger.Info("GUI launch...")
 	startGUI()
 }
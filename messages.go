@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Telegram limits a message to 4096 characters, we leave a margin for the markup
+	messagePartLimit = 4000
+	// Attempts of a request if Telegram asks to wait (error 429)
+	requestAttempts = 3
+	// The longest wait requested by Telegram that we agree to
+	maxRetryAfter = 60 * time.Second
+)
+
+// Splitting a long text into parts that fit into a Telegram message.
+// The text is split at paragraphs, then at lines and words; an unclosed code block is closed
+// at the end of a part and opened again at the beginning of the next one.
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	for utf8.RuneCountInString(text) > limit {
+		cut := findSplitPoint(text, limit)
+		part := strings.TrimRight(text[:cut], " \n")
+		rest := strings.TrimLeft(text[cut:], " \n")
+
+		if lang, open := openCodeFence(part); open {
+			part += "\n```"
+			rest = "```" + lang + "\n" + rest
+		}
+
+		if part != "" {
+			parts = append(parts, part)
+		}
+		text = rest
+	}
+
+	if strings.TrimSpace(text) != "" || len(parts) == 0 {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+// The position (in bytes) at which the text is split so that the part has no more than limit characters
+func findSplitPoint(text string, limit int) int {
+	// A margin for the fence that may be added at the end and at the beginning of a part
+	const fenceReserve = 24
+	if limit > 2*fenceReserve {
+		limit -= fenceReserve
+	}
+
+	window := text
+	n := 0
+	for i := range text {
+		if n == limit {
+			window = text[:i]
+			break
+		}
+		n++
+	}
+
+	// Split points by priority; too short parts are not made
+	minCut := len(window) / 2
+	for _, sep := range []string{"\n```\n", "\n\n", "\n", ". ", " "} {
+		if i := strings.LastIndex(window, sep); i > minCut {
+			if sep == "\n```\n" {
+				// We split after the closing fence or before the opening one
+				if _, open := openCodeFence(window[:i+4]); !open {
+					return i + 4
+				}
+				return i + 1
+			}
+			return i + len(sep)
+		}
+	}
+
+	return len(window)
+}
+
+// Checking whether the text ends inside a code block, returns the language of the block
+func openCodeFence(text string) (string, bool) {
+	lang, open := "", false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "```") {
+			continue
+		}
+		if open {
+			open = false
+			lang = ""
+		} else {
+			open = true
+			lang = strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+		}
+	}
+	return lang, open
+}
+
+// Showing the answer in the messages of the bot: existing messages are edited, missing ones are sent,
+// unnecessary ones are deleted. The buttons are attached to the last message.
+// Very long answers are sent as a .md document if it is enabled in the configuration.
+// Returns the IDs of the messages with the answer.
+func renderReply(key conversationKey, messageIDs []int, text string, keyboard *tgbotapi.InlineKeyboardMarkup) ([]int, error) {
+	if config.DocumentThreshold > 0 && utf8.RuneCountInString(text) > config.DocumentThreshold {
+		if reasoningMode() == reasoningHide {
+			text = answerWithoutReasoning(text)
+		}
+		return sendReplyDocument(key, messageIDs, text, keyboard)
+	}
+
+	parts := replyParts(text)
+	request := func(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+		return requestWithRetry(key, c)
+	}
+	var result []int
+	var firstErr error
+
+	for i, part := range parts {
+		var markup *tgbotapi.InlineKeyboardMarkup
+		if i == len(parts)-1 {
+			markup = keyboard
+		}
+
+		messageID := 0
+		if i < len(messageIDs) {
+			messageID = messageIDs[i]
+		}
+
+		id, err := deliverPart(key, messageID, part, markup, request)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if id != 0 {
+			result = append(result, id)
+		}
+	}
+
+	// The previous answer was longer: we delete the remaining messages
+	for i := len(parts); i < len(messageIDs); i++ {
+		_, _ = bot.Request(tgbotapi.NewDeleteMessage(key.ChatID, messageIDs[i]))
+	}
+
+	return result, firstErr
+}
+
+// Sending (messageID = 0) or editing of a message with a part of the answer in Markdown.
+// The part is converted to the markup of Telegram; if Telegram cannot parse it, the part is sent as plain text.
+// Returns the ID of the message.
+func deliverPart(key conversationKey, messageID int, markdown string, markup *tgbotapi.InlineKeyboardMarkup,
+	request func(tgbotapi.Chattable) (*tgbotapi.APIResponse, error)) (int, error) {
+	build := func(text, parseMode string) tgbotapi.Chattable {
+		if messageID != 0 {
+			edit := tgbotapi.NewEditMessageText(key.ChatID, messageID, text)
+			edit.ParseMode = parseMode
+			edit.ReplyMarkup = markup
+			return edit
+		}
+
+		msg := tgbotapi.NewMessage(key.ChatID, text)
+		msg.ParseMode = parseMode
+		if markup != nil {
+			msg.ReplyMarkup = *markup
+		}
+		return msg
+	}
+
+	text, parseMode := formatForTelegram(markdown)
+	resp, err := request(build(text, parseMode))
+	if isParseError(err) {
+		logger.Warnf("Telegram could not parse the markup, the message is sent as plain text: %v", err)
+		resp, err = request(build(markdown, ""))
+	}
+	if err != nil {
+		return messageID, err
+	}
+
+	if messageID == 0 && resp != nil {
+		var sent tgbotapi.Message
+		if err := json.Unmarshal(resp.Result, &sent); err != nil {
+			return 0, err
+		}
+		return sent.MessageID, nil
+	}
+	return messageID, nil
+}
+
+// Sending the answer as a .md document instead of the messages
+func sendReplyDocument(key conversationKey, messageIDs []int, text string, keyboard *tgbotapi.InlineKeyboardMarkup) ([]int, error) {
+	for _, id := range messageIDs {
+		_, _ = bot.Request(tgbotapi.NewDeleteMessage(key.ChatID, id))
+	}
+
+	doc := tgbotapi.NewDocument(key.ChatID, tgbotapi.FileBytes{
+		Name:  "answer.md",
+		Bytes: []byte(text),
+	})
+	doc.Caption = t("The answer is too long, it is attached as a file.")
+	if keyboard != nil {
+		doc.ReplyMarkup = *keyboard
+	}
+
+	sent, err := sendWithRetry(key, doc)
+	if err != nil {
+		return nil, err
+	}
+	return []int{sent.MessageID}, nil
+}
+
+// Sending a message to the chat of the conversation, repeated if Telegram asks to wait
+func sendWithRetry(key conversationKey, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var sent tgbotapi.Message
+	var err error
+	for attempt := 0; attempt < requestAttempts; attempt++ {
+		if sent, err = sendTo(key, c); err == nil {
+			return sent, nil
+		}
+
+		retryAfter, limited := telegramRetryAfter(err)
+		if !limited {
+			break
+		}
+		time.Sleep(retryAfter)
+	}
+	return sent, err
+}
+
+// Request to Telegram in the chat of the conversation, repeated if Telegram asks to wait.
+// An edit without changes is not an error.
+func requestWithRetry(key conversationKey, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	var err error
+	for attempt := 0; attempt < requestAttempts; attempt++ {
+		resp, err = requestTo(key, c)
+		if err == nil || isMessageNotModified(err) {
+			return resp, nil
+		}
+
+		retryAfter, limited := telegramRetryAfter(err)
+		if !limited {
+			break
+		}
+		time.Sleep(retryAfter)
+	}
+	return resp, err
+}
+
+// The wait requested by Telegram in error 429
+func telegramRetryAfter(err error) (time.Duration, bool) {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) || (tgErr.Code != 429 && tgErr.RetryAfter == 0) {
+		return 0, false
+	}
+
+	retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+	return retryAfter, true
+}
+
+// Telegram refuses edits that do not change the message, this is not an error for us
+func isMessageNotModified(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "message is not modified")
+}
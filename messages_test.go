@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	code := "```go\n" + strings.Repeat("fmt.Println(\"hello\")\n", 30) + "```"
+
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		parts int // Expected number of parts, 0 - more than one
+	}{
+		{"short text", "Hello, world!", 100, 1},
+		{"empty text", "", 100, 1},
+		{"long plain text", strings.Repeat("Lorem ipsum dolor sit amet. ", 40), 200, 0},
+		{"paragraphs", strings.Repeat("First paragraph of the text.\n\n", 20), 100, 0},
+		{"text without spaces", strings.Repeat("a", 1000), 100, 0},
+		{"cyrillic text", strings.Repeat("Съешь же ещё этих мягких французских булок. ", 30), 150, 0},
+		{"cyrillic without spaces", strings.Repeat("ж", 500), 100, 0},
+		{"code block crossing a split", "Intro text.\n\n" + code + "\n\nOutro text.", 200, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitMessage(tt.text, tt.limit)
+			if tt.parts > 0 && len(parts) != tt.parts {
+				t.Fatalf("got %d parts, want %d", len(parts), tt.parts)
+			}
+			if tt.parts == 0 && len(parts) < 2 {
+				t.Fatalf("got %d parts, want several", len(parts))
+			}
+
+			for i, part := range parts {
+				if !utf8.ValidString(part) {
+					t.Errorf("part %d is not valid UTF-8", i)
+				}
+				if n := utf8.RuneCountInString(part); n > tt.limit {
+					t.Errorf("part %d has %d characters, limit %d", i, n, tt.limit)
+				}
+				if _, open := openCodeFence(part); open {
+					t.Errorf("part %d ends inside a code block:\n%s", i, part)
+				}
+			}
+
+			// Nothing is lost except the whitespace at the splits and the added fences
+			joined := strings.Join(parts, "")
+			if stripSplit(joined) != stripSplit(tt.text) {
+				t.Errorf("the text changed after splitting:\n%q", joined)
+			}
+		})
+	}
+}
+
+func TestSplitMessageReopensCodeFence(t *testing.T) {
+	text := "```python\n" + strings.Repeat("print('line')\n", 40) + "```"
+	parts := splitMessage(text, 150)
+	if len(parts) < 2 {
+		t.Fatalf("got %d parts, want several", len(parts))
+	}
+	for i, part := range parts[1:] {
+		if !strings.HasPrefix(part, "```python\n") {
+			t.Errorf("part %d does not reopen the code block: %q", i+1, part[:min(len(part), 20)])
+		}
+	}
+}
+
+func TestOpenCodeFence(t *testing.T) {
+	tests := []struct {
+		text string
+		lang string
+		open bool
+	}{
+		{"plain text", "", false},
+		{"```go\nfunc main() {}", "go", true},
+		{"```go\nfunc main() {}\n```", "", false},
+		{"```\ncode\n```\n\n```js\nlet a", "js", true},
+		{"  ```sh\nls", "sh", true},
+	}
+
+	for _, tt := range tests {
+		lang, open := openCodeFence(tt.text)
+		if lang != tt.lang || open != tt.open {
+			t.Errorf("openCodeFence(%q) = %q, %v; want %q, %v", tt.text, lang, open, tt.lang, tt.open)
+		}
+	}
+}
+
+// The text without what splitting may change: the whitespace and the fences of code blocks
+func stripSplit(text string) string {
+	for _, fence := range []string{"```python", "```go", "```"} {
+		text = strings.ReplaceAll(text, fence, "")
+	}
+	return strings.Join(strings.Fields(text), "")
+}
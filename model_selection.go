@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The model for the request of the user in the chat: the model of the chat, the global default model
+// or the first model of the role or of the user, whichever the user may use first.
+// Returns false if the user may use none of them.
+func resolveChatModel(chatID, userID int64) (string, bool) {
+	candidates := []string{getChatModel(chatID), selectedModel}
+	candidates = append(candidates, limitsForRole(userRole(userID)).Models...)
+
+	usersMutex.Lock()
+	if u, ok := users[userID]; ok {
+		candidates = append(candidates, u.AllowedModels...)
+	}
+	usersMutex.Unlock()
+
+	for _, model := range candidates {
+		if userCanUseModel(userID, model) {
+			return model, true
+		}
+	}
+	return "", false
+}
+
+// Models from LM Studio that the user may choose
+func availableModelsForUser(userID int64) ([]string, error) {
+	models, err := fetchModels(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, m := range models {
+		if userCanUseModel(userID, m) {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// The /model command: "/model" shows the list of models, "/model <name>" selects the model,
+// "/model default" returns the global default model
+func modelCommand(message *tgbotapi.Message) tgbotapi.MessageConfig {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	msg := tgbotapi.NewMessage(chatID, "")
+
+	models, err := availableModelsForUser(userID)
+	if err != nil {
+		logger.Errorf("Error getting models: %v", err)
+		msg.Text = t("Error getting models")
+		return msg
+	}
+
+	if arg := strings.TrimSpace(message.CommandArguments()); arg != "" {
+		if arg == "default" {
+			if err := setChatModel(chatID, ""); err != nil {
+				logger.Errorf("Error saving chat settings: %v", err)
+			}
+			// The global default model may be closed to the user, then the model of the request is reported
+			model, ok := resolveChatModel(chatID, userID)
+			if !ok {
+				msg.Text = t("No models are available to you.")
+				return msg
+			}
+			msg.Text = t("The default model is used: %s", model)
+			return msg
+		}
+
+		for _, m := range models {
+			if m == arg {
+				if err := setChatModel(chatID, m); err != nil {
+					logger.Errorf("Error saving chat settings: %v", err)
+				}
+				msg.Text = t("Model selected: %s", m)
+				return msg
+			}
+		}
+
+		msg.Text = t("The model is not available: %s", arg)
+		return msg
+	}
+
+	if len(models) == 0 {
+		msg.Text = t("No models are available to you.")
+		return msg
+	}
+
+	current, _ := resolveChatModel(chatID, userID)
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, m := range models {
+		label := m
+		if m == current {
+			label = "✅ " + m
+		}
+		// Callback data is limited to 64 bytes, so we pass the hash of the name of the model
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, callbackData("model", modelCallbackID(m))),
+		))
+	}
+
+	msg.Text = t("Current model: %s\nChoose a model for this chat:", current)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return msg
+}
+
+// The ID of the model in the callback data: it does not depend on the list of the user who pressed the button
+func modelCallbackID(model string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(model))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// Processing the choice of the model from the inline keyboard of the /model command.
+// The button could be pressed by another user of the group, so the model is checked for this user.
+func handleModelCallback(query *tgbotapi.CallbackQuery, data string) string {
+	chatID := query.Message.Chat.ID
+
+	models, err := fetchModels(context.Background())
+	if err != nil {
+		logger.Errorf("Error getting models: %v", err)
+		return t("Error getting models")
+	}
+
+	model := ""
+	for _, m := range models {
+		if modelCallbackID(m) == data {
+			model = m
+			break
+		}
+	}
+	// The list of models could change after the keyboard was sent
+	if model == "" {
+		return t("The list of models has changed, send /model again.")
+	}
+	if !userCanUseModel(query.From.ID, model) {
+		return t("The model is not available: %s", model)
+	}
+
+	if err := setChatModel(chatID, model); err != nil {
+		logger.Errorf("Error saving chat settings: %v", err)
+	}
+	logger.Infof("Chat %d selected the model: %s", chatID, model)
+
+	edit := tgbotapi.NewEditMessageText(chatID, query.Message.MessageID, t("Model selected: %s", model))
+	if _, err := bot.Request(edit); err != nil {
+		logger.Errorf("Error editing message: %v", err)
+	}
+
+	return t("Model selected: %s", model)
+}
+
+// The /allowmodels command (administrators only): "/allowmodels <user_id> [model ...]"
+// restricts the models of the user, without models the restriction is removed
+func allowModelsCommand(message *tgbotapi.Message) string {
+	if !isAdmin(message.From.ID) {
+		return t("This command is available only to administrators.")
+	}
+
+	args := strings.Fields(message.CommandArguments())
+	if len(args) == 0 {
+		return t("Usage: /allowmodels <user_id> [model ...]")
+	}
+
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return t("Usage: /allowmodels <user_id> [model ...]")
+	}
+
+	models := args[1:]
+	if !setUserAllowedModels(userID, models) {
+		return t("User %d not found.", userID)
+	}
+	if err := saveUsers(); err != nil {
+		logger.Errorf("Error saving users: %v", err)
+	}
+
+	if len(models) == 0 {
+		return t("User %d may use any model.", userID)
+	}
+	return t("User %d may use: %s", userID, strings.Join(models, ", "))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ollamaBackend A server with the native API of Ollama
+type ollamaBackend struct {
+	hostPool
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"` // Base64 without the data URL prefix
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"` // JSON object, not a string as in the OpenAI API
+	} `json:"function"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []LMTool        `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+// ollamaChatResponse The answer or, when streaming, one line of it
+type ollamaChatResponse struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+type ollamaTagsResponse struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+type ollamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+func (b *ollamaBackend) Name() string {
+	return b.name
+}
+
+// Getting the list of local models (of all hosts of the backend)
+func (b *ollamaBackend) Models(ctx context.Context) ([]string, error) {
+	return b.models(ctx, "/api/tags", func(resp *http.Response) ([]string, error) {
+		var tags ollamaTagsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+			return nil, fmt.Errorf("error parsing response: %v", err)
+		}
+
+		var models []string
+		for _, m := range tags.Models {
+			models = append(models, m.Name)
+		}
+		return models, nil
+	})
+}
+
+// The full answer of /api/chat
+func (b *ollamaBackend) Chat(ctx context.Context, chat ChatRequest) (LMMessage, LMUsage, error) {
+	resp, release, err := b.request(ctx, http.MethodPost, "/api/chat", chat.Model, b.chatRequest(chat, false))
+	if err != nil {
+		return LMMessage{}, LMUsage{}, fmt.Errorf("Ollama %v", err)
+	}
+	defer release()
+	defer closeBody(resp.Body)
+
+	var result ollamaChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return LMMessage{}, LMUsage{}, fmt.Errorf("error parsing response: %v", err)
+	}
+	if result.Error != "" {
+		return LMMessage{}, LMUsage{}, fmt.Errorf("Ollama error: %s", result.Error)
+	}
+
+	return fromOllamaMessage(result.Message), result.usage(), nil
+}
+
+// The streaming answer of /api/chat: one JSON object per line
+func (b *ollamaBackend) ChatStream(ctx context.Context, chat ChatRequest, onStart func() error, onText func(text string)) (LMMessage, LMUsage, error) {
+	message := LMMessage{Role: "assistant"}
+	var usage LMUsage
+
+	resp, release, err := b.request(ctx, http.MethodPost, "/api/chat", chat.Model, b.chatRequest(chat, true))
+	if err != nil {
+		return message, usage, fmt.Errorf("Ollama %v", err)
+	}
+	defer release()
+	defer closeBody(resp.Body)
+
+	// We send the initial message that we will edit
+	if onStart != nil {
+		if err := onStart(); err != nil {
+			return message, usage, fmt.Errorf("error sending message: %v", err)
+		}
+	}
+
+	var fullResponse string
+	var toolCalls []LMToolCall
+	chunks := 0 // Chunks with text, if the server does not report the usage
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk ollamaChatResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			logger.Errorf("Chunk parsing error: %v", err)
+			continue
+		}
+		if chunk.Error != "" {
+			message.Content = fullResponse
+			return message, usage, fmt.Errorf("Ollama error: %s", chunk.Error)
+		}
+
+		// Tool calls come whole in one line
+		toolCalls = append(toolCalls, fromOllamaMessage(chunk.Message).ToolCalls...)
+		if chunk.Message.Content != "" {
+			fullResponse += chunk.Message.Content
+			chunks++
+			onText(fullResponse)
+		}
+
+		if chunk.Done {
+			usage = chunk.usage()
+			break
+		}
+	}
+
+	message.Content = fullResponse
+	message.ToolCalls = toolCalls
+	if usage.CompletionTokens == 0 {
+		usage.CompletionTokens = chunks
+	}
+	if err := scanner.Err(); err != nil {
+		message.ToolCalls = nil
+		return message, usage, err
+	}
+
+	return message, usage, nil
+}
+
+// Calling /api/embed
+func (b *ollamaBackend) Embeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	resp, release, err := b.request(ctx, http.MethodPost, "/api/embed", model, ollamaEmbedRequest{Model: model, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("embeddings %v", err)
+	}
+	defer release()
+	defer closeBody(resp.Body)
+
+	var result ollamaEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+	if len(result.Embeddings) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(result.Embeddings))
+	}
+	return result.Embeddings, nil
+}
+
+// The request in the format of Ollama: images without the data URL prefix, the generation parameters in options
+func (b *ollamaBackend) chatRequest(chat ChatRequest, stream bool) ollamaChatRequest {
+	req := ollamaChatRequest{
+		Model:   chat.Model,
+		Tools:   chat.Tools,
+		Stream:  stream,
+		Options: ollamaOptions(chat.Params),
+	}
+
+	for _, m := range chat.Messages {
+		msg := ollamaMessage{Role: m.Role, Content: m.Content}
+		for _, url := range m.Images {
+			if _, data, ok := strings.Cut(url, ","); ok {
+				msg.Images = append(msg.Images, data)
+			}
+		}
+		for _, call := range m.ToolCalls {
+			var c ollamaToolCall
+			c.Function.Name = call.Function.Name
+			c.Function.Arguments = json.RawMessage(call.Function.Arguments)
+			if !json.Valid(c.Function.Arguments) {
+				c.Function.Arguments = json.RawMessage("{}")
+			}
+			msg.ToolCalls = append(msg.ToolCalls, c)
+		}
+		req.Messages = append(req.Messages, msg)
+	}
+	return req
+}
+
+// Generation parameters under the names of Ollama
+func ollamaOptions(params SamplingParams) map[string]any {
+	options := make(map[string]any)
+	if params.Temperature != nil {
+		options["temperature"] = *params.Temperature
+	}
+	if params.TopP != nil {
+		options["top_p"] = *params.TopP
+	}
+	if params.MaxTokens != nil {
+		options["num_predict"] = *params.MaxTokens
+	}
+	if len(params.Stop) > 0 {
+		options["stop"] = params.Stop
+	}
+	if params.PresencePenalty != nil {
+		options["presence_penalty"] = *params.PresencePenalty
+	}
+	if params.FrequencyPenalty != nil {
+		options["frequency_penalty"] = *params.FrequencyPenalty
+	}
+	if params.Seed != nil {
+		options["seed"] = *params.Seed
+	}
+	return options
+}
+
+// The message of Ollama in the common format (the arguments of the calls become a string)
+func fromOllamaMessage(m ollamaMessage) LMMessage {
+	msg := LMMessage{Role: m.Role, Content: m.Content}
+	for _, c := range m.ToolCalls {
+		arguments := string(c.Function.Arguments)
+		if arguments == "" || arguments == "null" {
+			arguments = "{}"
+		}
+		msg.ToolCalls = append(msg.ToolCalls, LMToolCall{
+			Type:     "function",
+			Function: LMFunctionCall{Name: c.Function.Name, Arguments: arguments},
+		})
+	}
+	return msg
+}
+
+// Token counts of the answer
+func (r ollamaChatResponse) usage() LMUsage {
+	return LMUsage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaLimits Limits of the use of the models (0 - no limit)
+type QuotaLimits struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	TokensPerDay      int `json:"tokens_per_day,omitempty"` // Generated (completion) tokens
+	MaxConcurrent     int `json:"max_concurrent,omitempty"` // Generations running or waiting in the queue
+}
+
+// UserUsage The use of the models by the user
+type UserUsage struct {
+	Day      string  `json:"day"`    // The day of Tokens (YYYY-MM-DD, local time)
+	Tokens   int     `json:"tokens"` // Tokens generated during the day
+	Requests []int64 `json:"requests,omitempty"`
+}
+
+var (
+	usageStats    = make(map[int64]*UserUsage)
+	usageFileName = "usage.json"
+	usageMutex    sync.Mutex
+)
+
+// Loading the usage of the users from a file
+func loadUsage() error {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	data, err := os.ReadFile(usageFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			usageStats = make(map[int64]*UserUsage)
+			return nil
+		}
+		return err
+	}
+
+	loaded := make(map[int64]*UserUsage)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	usageStats = loaded
+	return nil
+}
+
+// Saving the usage of the users to a file
+func saveUsageLocked() {
+	data, err := json.MarshalIndent(usageStats, "", "  ")
+	if err != nil {
+		logger.Errorf("Error saving usage: %v", err)
+		return
+	}
+	if err := writeFileAtomic(usageFileName, data, 0644); err != nil {
+		logger.Errorf("Error saving usage: %v", err)
+	}
+}
+
+// The usage of the user with the counters of the past day and minute reset
+func userUsageLocked(userID int64, now time.Time) *UserUsage {
+	u, ok := usageStats[userID]
+	if !ok {
+		u = &UserUsage{}
+		usageStats[userID] = u
+	}
+
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day = day
+		u.Tokens = 0
+	}
+
+	minuteAgo := now.Add(-time.Minute).Unix()
+	recent := u.Requests[:0]
+	for _, ts := range u.Requests {
+		if ts > minuteAgo {
+			recent = append(recent, ts)
+		}
+	}
+	u.Requests = recent
+	return u
+}
+
+// The limits of the user: the limits of the role with the limits of the user over them
+// (a negative limit of the user removes the limit of the role)
+func userQuota(userID int64) QuotaLimits {
+	usersMutex.Lock()
+	role := roleGuest
+	var own *QuotaLimits
+	if u, ok := users[userID]; ok {
+		role = u.Role
+		own = u.Quota
+	}
+	usersMutex.Unlock()
+
+	quota := limitsForRole(role).QuotaLimits
+	if own != nil {
+		override := func(limit *int, value int) {
+			if value < 0 {
+				*limit = 0
+			} else if value > 0 {
+				*limit = value
+			}
+		}
+		override(&quota.RequestsPerMinute, own.RequestsPerMinute)
+		override(&quota.TokensPerDay, own.TokensPerDay)
+		override(&quota.MaxConcurrent, own.MaxConcurrent)
+	}
+	return quota
+}
+
+// Checking the limits of requests and tokens before a new generation of the user; the request
+// is counted if it is allowed (the simultaneous requests are limited by enqueueGeneration).
+// Returns the explanation for the user if a limit is reached.
+func admitGeneration(userID int64) string {
+	quota := userQuota(userID)
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	now := time.Now()
+	u := userUsageLocked(userID, now)
+
+	if quota.TokensPerDay > 0 && u.Tokens >= quota.TokensPerDay {
+		return t("📊 Your daily limit of %d tokens is used up. It will be renewed at midnight.", quota.TokensPerDay)
+	}
+
+	if quota.RequestsPerMinute > 0 && len(u.Requests) >= quota.RequestsPerMinute {
+		wait := u.Requests[0] + 60 - now.Unix()
+		return t("⏳ Too many requests: no more than %d per minute. Please try again in %d s.", quota.RequestsPerMinute, max(wait, 1))
+	}
+
+	u.Requests = append(u.Requests, now.Unix())
+	saveUsageLocked()
+	return ""
+}
+
+// Counting the tokens generated for the user
+func recordUsage(userID int64, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	u := userUsageLocked(userID, time.Now())
+	u.Tokens += tokens
+	saveUsageLocked()
+}
+
+// The /usage command: the use of the limits by the user
+func usageCommand(userID int64) string {
+	quota := userQuota(userID)
+
+	usageMutex.Lock()
+	u := userUsageLocked(userID, time.Now())
+	tokens, requests := u.Tokens, len(u.Requests)
+	usageMutex.Unlock()
+
+	limit := func(used, limit int) string {
+		if limit <= 0 {
+			return t("%d (no limit)", used)
+		}
+		return t("%d of %d, %d left", used, limit, max(limit-used, 0))
+	}
+
+	lines := []string{
+		t("📊 Your usage:"),
+		fmt.Sprintf("%s: %s", t("Tokens today"), limit(tokens, quota.TokensPerDay)),
+		fmt.Sprintf("%s: %s", t("Requests in the last minute"), limit(requests, quota.RequestsPerMinute)),
+		fmt.Sprintf("%s: %s", t("Requests in progress"), limit(scheduler.userJobs(userID), quota.MaxConcurrent)),
+	}
+	return strings.Join(lines, "\n")
+}
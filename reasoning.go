@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// Display modes of the reasoning of the model
+const (
+	reasoningHide       = "hide"       // The reasoning is not shown
+	reasoningExpandable = "expandable" // Collapsed quote above the answer
+	reasoningSpoiler    = "spoiler"    // Spoiler above the answer
+	reasoningMessage    = "message"    // Separate message before the answer
+)
+
+// The display mode of the reasoning from the configuration ("expandable" by default)
+func reasoningMode() string {
+	switch config.ReasoningMode {
+	case reasoningHide, reasoningSpoiler, reasoningMessage:
+		return config.ReasoningMode
+	default:
+		return reasoningExpandable
+	}
+}
+
+// Separating the reasoning of the model (<think> blocks) from the answer.
+// thinking is true if the last block is not closed yet, that is, the model is still reasoning.
+func splitReasoning(text string) (reasoning, answer string, thinking bool) {
+	var blocks []string
+	var sb strings.Builder
+
+	// The opening tag can be in the prompt template, then the text starts right with the reasoning
+	open, closing := strings.Index(text, thinkOpenTag), strings.Index(text, thinkCloseTag)
+	if closing >= 0 && (open < 0 || closing < open) {
+		blocks = append(blocks, text[:closing])
+		text = text[closing+len(thinkCloseTag):]
+	}
+
+	for {
+		start := strings.Index(text, thinkOpenTag)
+		if start < 0 {
+			sb.WriteString(text)
+			break
+		}
+		sb.WriteString(text[:start])
+
+		rest := text[start+len(thinkOpenTag):]
+		end := strings.Index(rest, thinkCloseTag)
+		if end < 0 {
+			blocks = append(blocks, rest)
+			thinking = true
+			break
+		}
+		blocks = append(blocks, rest[:end])
+		text = rest[end+len(thinkCloseTag):]
+	}
+
+	var parts []string
+	for _, block := range blocks {
+		if block = strings.TrimSpace(block); block != "" {
+			parts = append(parts, block)
+		}
+	}
+
+	return strings.Join(parts, "\n\n"), strings.TrimSpace(sb.String()), thinking
+}
+
+// The answer without the reasoning (it is not kept in the context of the chat)
+func stripReasoning(text string) string {
+	_, answer, _ := splitReasoning(text)
+	return answer
+}
+
+// Closing the unfinished reasoning (the generation was stopped while the model was reasoning)
+func closeReasoning(text string) string {
+	if _, _, thinking := splitReasoning(text); thinking {
+		return text + thinkCloseTag
+	}
+	return text
+}
+
+// The text shown while the answer is being generated: the unfinished reasoning is replaced by an indicator
+func streamingText(text string) string {
+	_, answer, thinking := splitReasoning(text)
+	if !thinking {
+		return answer
+	}
+
+	indicator := "_" + t("💭 Thinking…") + "_"
+	if answer == "" {
+		return indicator
+	}
+	return answer + "\n\n" + indicator
+}
+
+// The answer without the reasoning. An answer of the reasoning only is replaced with a note,
+// because Telegram does not send empty messages.
+func answerWithoutReasoning(text string) string {
+	answer := stripReasoning(text)
+	if strings.TrimSpace(answer) == "" {
+		return t("💭 The model only reasoned and gave no answer.")
+	}
+	return answer
+}
+
+// Parts of the answer for the messages. Depending on the mode the reasoning is removed
+// or goes to separate messages before the answer.
+func replyParts(text string) []string {
+	switch reasoningMode() {
+	case reasoningHide:
+		return splitMessage(answerWithoutReasoning(text), messagePartLimit)
+	case reasoningMessage:
+		reasoning, answer, _ := splitReasoning(text)
+		if reasoning == "" {
+			break
+		}
+		parts := splitMessage(thinkOpenTag+reasoning+thinkCloseTag, messagePartLimit)
+		if answer != "" {
+			parts = append(parts, splitMessage(answer, messagePartLimit)...)
+		}
+		return parts
+	}
+	return splitMessage(text, messagePartLimit)
+}
+
+// The reasoning in the markup of Telegram: a collapsed quote or a spoiler
+func (r *telegramRenderer) reasoning(text string) string {
+	title := t("💭 Reasoning")
+
+	if reasoningMode() == reasoningSpoiler {
+		if r.html {
+			return "<b>" + htmlEscaper.Replace(title) + "</b>\n<tg-spoiler>" + htmlEscaper.Replace(text) + "</tg-spoiler>"
+		}
+		return "*" + markdownV2Escaper.Replace(title) + "*\n||" + markdownV2Escaper.Replace(text) + "||"
+	}
+
+	if r.html {
+		return "<blockquote expandable><b>" + htmlEscaper.Replace(title) + "</b>\n" + htmlEscaper.Replace(text) + "</blockquote>"
+	}
+
+	// Expandable quote of MarkdownV2: "**>" before the first line and "||" after the last one
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = ">" + markdownV2Escaper.Replace(line)
+	}
+	return "**>" + markdownV2Escaper.Replace(title) + "\n" + strings.Join(lines, "\n") + "||"
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestSplitReasoning(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		reasoning string
+		answer    string
+		thinking  bool
+	}{
+		{"no reasoning", "Just an answer.", "", "Just an answer.", false},
+		{"closed block", "<think>Let me see.</think>\n\nThe answer.", "Let me see.", "The answer.", false},
+		{"unclosed block", "<think>Still thinking", "Still thinking", "", true},
+		{"unclosed block after text", "Intro <think>hmm", "hmm", "Intro", true},
+		{"bare closing tag", "Reasoning from the template</think>The answer.", "Reasoning from the template", "The answer.", false},
+		{"several blocks", "<think>one</think>A<think>two</think>B", "one\n\ntwo", "AB", false},
+		{"bare closing tag and a block", "first</think>A<think>second</think>B", "first\n\nsecond", "AB", false},
+		{"empty block", "<think>  </think>Answer", "", "Answer", false},
+		{"only reasoning", "<think>only</think>", "only", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasoning, answer, thinking := splitReasoning(tt.text)
+			if reasoning != tt.reasoning || answer != tt.answer || thinking != tt.thinking {
+				t.Errorf("splitReasoning(%q) = %q, %q, %v; want %q, %q, %v",
+					tt.text, reasoning, answer, thinking, tt.reasoning, tt.answer, tt.thinking)
+			}
+		})
+	}
+}
+
+func TestStripReasoning(t *testing.T) {
+	tests := map[string]string{
+		"<think>a</think>b":         "b",
+		"a</think>b":                "b",
+		"<think>a":                  "",
+		"x<think>a</think>y<think>": "xy",
+		"plain":                     "plain",
+	}
+	for text, want := range tests {
+		if got := stripReasoning(text); got != want {
+			t.Errorf("stripReasoning(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestReplyPartsHiddenReasoningOnly(t *testing.T) {
+	saved := config.ReasoningMode
+	defer func() { config.ReasoningMode = saved }()
+	config.ReasoningMode = reasoningHide
+
+	parts := replyParts("<think>only reasoning</think>")
+	if len(parts) != 1 || parts[0] == "" {
+		t.Errorf("got %q, want one non-empty part", parts)
+	}
+}
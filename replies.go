@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// replyState The last answer of the bot in the chat and its alternatives after regeneration
+type replyState struct {
+	MessageIDs   []int // Long answers take several messages, the buttons are under the last one
+	Alternatives []string
+	Current      int
+	Busy         bool // The answer is being regenerated right now
+}
+
+var (
+	// The last answer of the bot in each conversation: only it has buttons
+	lastReplies      = make(map[conversationKey]*replyState)
+	lastRepliesMutex sync.Mutex
+)
+
+// The message with the buttons
+func (s *replyState) lastMessageID() int {
+	if len(s.MessageIDs) == 0 {
+		return 0
+	}
+	return s.MessageIDs[len(s.MessageIDs)-1]
+}
+
+// Adding a new alternative of the answer, the oldest ones are removed over the limit
+func (s *replyState) addAlternative(text string) {
+	if config.MaxAlternatives <= 1 {
+		s.Alternatives = []string{text}
+	} else {
+		s.Alternatives = append(s.Alternatives, text)
+		if extra := len(s.Alternatives) - config.MaxAlternatives; extra > 0 {
+			s.Alternatives = s.Alternatives[extra:]
+		}
+	}
+	s.Current = len(s.Alternatives) - 1
+}
+
+// Buttons under the answer of the bot (with paging if there are several alternatives)
+func replyKeyboard(state *replyState) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	if n := len(state.Alternatives); n > 1 {
+		prev := (state.Current - 1 + n) % n
+		next := (state.Current + 1) % n
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("◀", callbackData("alt", strconv.Itoa(prev))),
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d/%d", state.Current+1, n), callbackData("alt", strconv.Itoa(state.Current))),
+			tgbotapi.NewInlineKeyboardButtonData("▶", callbackData("alt", strconv.Itoa(next))),
+		))
+	}
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(t("🔄 Regenerate"), callbackData("regen", "")),
+		tgbotapi.NewInlineKeyboardButtonData(t("➡️ Continue"), callbackData("cont", "")),
+		tgbotapi.NewInlineKeyboardButtonData(t("🧹 Clear context"), callbackData("clear", "")),
+	))
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// Answer of the model to the new message of the user
+func replyToPrompt(key conversationKey, userID int64) {
+	state := &replyState{}
+	state.addAlternative("")
+
+	response, messageIDs, err := generateReply(key, userID, nil, replyKeyboard(state))
+	rememberReplyChain(key, messageIDs...)
+	if err != nil {
+		return
+	}
+
+	state.MessageIDs = messageIDs
+	state.Alternatives[state.Current] = response
+	setLastReply(key, state)
+}
+
+// Remembering the last answer of the conversation, the buttons are removed from the previous one
+func setLastReply(key conversationKey, state *replyState) {
+	lastRepliesMutex.Lock()
+	previous, ok := lastReplies[key]
+	lastReplies[key] = state
+	lastRepliesMutex.Unlock()
+
+	if ok && previous.lastMessageID() != state.lastMessageID() {
+		removeKeyboard(key.ChatID, previous.lastMessageID())
+	}
+}
+
+// Forgetting the last answer of the conversation (for example, after clearing the history)
+func forgetLastReply(key conversationKey) {
+	lastRepliesMutex.Lock()
+	previous, ok := lastReplies[key]
+	delete(lastReplies, key)
+	lastRepliesMutex.Unlock()
+
+	if ok {
+		removeKeyboard(key.ChatID, previous.lastMessageID())
+	}
+}
+
+// Regeneration of the last answer of the conversation in place: the answer is removed from the context,
+// the same conversation is sent to the model again and the message of the bot is edited.
+// Returns the text for the user if the answer cannot be regenerated.
+func retryLastReply(key conversationKey, userID int64) string {
+	lastRepliesMutex.Lock()
+	state, ok := lastReplies[key]
+	if !ok {
+		lastRepliesMutex.Unlock()
+		return t("There is no answer to regenerate.")
+	}
+	if state.Busy {
+		lastRepliesMutex.Unlock()
+		return t("The answer is already being regenerated.")
+	}
+	state.Busy = true
+	// The keyboard of the answer with the new alternative
+	preview := &replyState{Alternatives: append([]string(nil), state.Alternatives...)}
+	preview.addAlternative("")
+	messageIDs := state.MessageIDs
+	lastRepliesMutex.Unlock()
+
+	defer func() {
+		lastRepliesMutex.Lock()
+		state.Busy = false
+		lastRepliesMutex.Unlock()
+	}()
+
+	if !dropLastAssistantMessage(key) {
+		return t("There is no answer to regenerate.")
+	}
+
+	response, messageIDs, err := generateReply(key, userID, messageIDs, replyKeyboard(preview))
+	rememberReplyChain(key, messageIDs...)
+	if err != nil {
+		// We return the previous answer to the context and to the messages
+		lastRepliesMutex.Lock()
+		previous := state.Alternatives[state.Current]
+		keyboard := replyKeyboard(state)
+		lastRepliesMutex.Unlock()
+
+		appendToConversation(key, userID, "assistant", answerForContext(previous))
+		if ids, _ := renderReply(key, messageIDs, previous, &keyboard); len(ids) > 0 {
+			messageIDs = ids
+			rememberReplyChain(key, ids...)
+		}
+
+		lastRepliesMutex.Lock()
+		state.MessageIDs = messageIDs
+		lastRepliesMutex.Unlock()
+		return ""
+	}
+
+	lastRepliesMutex.Lock()
+	state.MessageIDs = messageIDs
+	state.addAlternative(response)
+	lastRepliesMutex.Unlock()
+
+	return ""
+}
+
+// Adding the regeneration of the last answer of the conversation to the queue of the chat.
+// Returns the explanation if a limit of the user is reached.
+func enqueueRetry(key conversationKey, userID int64) string {
+	if denial := admitGeneration(userID); denial != "" {
+		return denial
+	}
+	return enqueueGeneration(key, userID, func() {
+		if text := retryLastReply(key, userID); text != "" {
+			_, _ = sendTo(key, tgbotapi.NewMessage(key.ChatID, text))
+		}
+	})
+}
+
+// The "Regenerate" button
+func handleRegenerateCallback(query *tgbotapi.CallbackQuery, _ string) string {
+	chatID := query.Message.Chat.ID
+	key := messageConversation(query.Message)
+
+	lastRepliesMutex.Lock()
+	state, ok := lastReplies[key]
+	isLast := ok && state.lastMessageID() == query.Message.MessageID
+	lastRepliesMutex.Unlock()
+
+	if !isLast {
+		removeKeyboard(chatID, query.Message.MessageID)
+		return t("This answer can no longer be regenerated.")
+	}
+
+	if denial := enqueueRetry(key, query.From.ID); denial != "" {
+		return denial
+	}
+	return t("Regenerating...")
+}
+
+// Paging between the alternatives of the answer
+func handleAlternativeCallback(query *tgbotapi.CallbackQuery, data string) string {
+	chatID := query.Message.Chat.ID
+	key := messageConversation(query.Message)
+	index, err := strconv.Atoi(data)
+	if err != nil {
+		return t("Unknown action.")
+	}
+
+	lastRepliesMutex.Lock()
+	state, ok := lastReplies[key]
+	if !ok || state.lastMessageID() != query.Message.MessageID {
+		lastRepliesMutex.Unlock()
+		removeKeyboard(chatID, query.Message.MessageID)
+		return t("This answer can no longer be changed.")
+	}
+	if state.Busy || index < 0 || index >= len(state.Alternatives) || index == state.Current {
+		lastRepliesMutex.Unlock()
+		return ""
+	}
+
+	state.Current = index
+	state.Busy = true
+	text := state.Alternatives[index]
+	count := len(state.Alternatives)
+	keyboard := replyKeyboard(state)
+	messageIDs := state.MessageIDs
+	lastRepliesMutex.Unlock()
+
+	// The selected alternative becomes the answer in the context of the conversation
+	replaceLastAssistantMessage(key, answerForContext(text))
+
+	ids, err := renderReply(key, messageIDs, text, &keyboard)
+	if err != nil {
+		logger.Errorf("Error editing message: %v", err)
+	}
+
+	rememberReplyChain(key, ids...)
+	lastRepliesMutex.Lock()
+	if len(ids) > 0 {
+		state.MessageIDs = ids
+	}
+	state.Busy = false
+	lastRepliesMutex.Unlock()
+
+	return fmt.Sprintf("%d/%d", index+1, count)
+}
+
+// The text of the shown answer for the context of the chat: without the reasoning and the list of sources
+func answerForContext(text string) string {
+	return stripSources(stripReasoning(text))
+}
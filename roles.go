@@ -0,0 +1,177 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// User roles
+const (
+	roleAdmin  = "admin"
+	roleUser   = "user"
+	roleGuest  = "guest"  // New users; has no access until the guest limits allow it
+	roleBanned = "banned" // Never has access
+)
+
+// All roles in the order of display
+var roles = []string{roleAdmin, roleUser, roleGuest, roleBanned}
+
+// RoleLimits What the users of a role may do
+type RoleLimits struct {
+	Access      bool     `json:"access"`                 // Whether the bot answers the users of the role
+	Models      []string `json:"models,omitempty"`       // Models the role may use (empty - any model)
+	MaxContext  int      `json:"max_context,omitempty"`  // Maximum context in tokens (0 - token_limit)
+	FileUploads bool     `json:"file_uploads,omitempty"` // Whether documents and images may be sent
+	QuotaLimits
+}
+
+// Limits of the roles that are not set in the configuration
+var defaultRoleLimits = map[string]RoleLimits{
+	roleUser:  {Access: true, FileUploads: true},
+	roleGuest: {Access: false},
+}
+
+// Checking the name of the role
+func isValidRole(role string) bool {
+	return slices.Contains(roles, role)
+}
+
+// The limits of the role: from the configuration or by default.
+// Administrators always have access to everything, banned users never have access.
+func limitsForRole(role string) RoleLimits {
+	switch role {
+	case roleAdmin:
+		return RoleLimits{Access: true, FileUploads: true}
+	case roleBanned:
+		return RoleLimits{}
+	}
+
+	if limits, ok := config.RoleLimits[role]; ok {
+		return limits
+	}
+	return defaultRoleLimits[role]
+}
+
+// The role of the user (unknown users are guests)
+func userRole(userID int64) string {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	if u, ok := users[userID]; ok {
+		return u.Role
+	}
+	return roleGuest
+}
+
+// Whether the bot answers the user
+func hasAccess(u *BotUser) bool {
+	usersMutex.Lock()
+	role := u.Role
+	usersMutex.Unlock()
+
+	return limitsForRole(role).Access
+}
+
+// Whether the user may send documents and images
+func canUploadFiles(userID int64) bool {
+	return limitsForRole(userRole(userID)).FileUploads
+}
+
+// The token budget of the context for the requests of the user
+func contextLimit(userID int64) int {
+	limit := config.TokenLimit
+	if maxContext := limitsForRole(userRole(userID)).MaxContext; maxContext > 0 && maxContext < limit {
+		limit = maxContext
+	}
+	return limit
+}
+
+// The role from the legacy flags of users.json
+func migrateRole(admin, allowed bool) string {
+	switch {
+	case admin:
+		return roleAdmin
+	case allowed:
+		return roleUser
+	default:
+		return roleGuest
+	}
+}
+
+// Search for a user by ID or by @username
+func findUser(arg string) (*BotUser, bool) {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		u, ok := users[id]
+		return u, ok
+	}
+
+	name := strings.TrimPrefix(arg, "@")
+	for _, u := range users {
+		if strings.EqualFold(u.Username, name) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// The /grant command (admins): "/grant <user_id|@username> [role]" sets the role of the user ("user" by default)
+func grantCommand(message *tgbotapi.Message) string {
+	if !isAdmin(message.From.ID) {
+		return t("This command is available only to administrators.")
+	}
+
+	args := strings.Fields(message.CommandArguments())
+	if len(args) < 1 || len(args) > 2 {
+		return t("Usage: /grant <user_id|@username> [%s]", strings.Join(roles, "|"))
+	}
+
+	role := roleUser
+	if len(args) == 2 {
+		role = strings.ToLower(args[1])
+	}
+	if !isValidRole(role) {
+		return t("Unknown role: %s", role)
+	}
+
+	return changeUserRole(message.From.ID, args[0], role)
+}
+
+// The /revoke command (admins): "/revoke <user_id|@username>" takes the access away (the user becomes a guest)
+func revokeCommand(message *tgbotapi.Message) string {
+	if !isAdmin(message.From.ID) {
+		return t("This command is available only to administrators.")
+	}
+
+	args := strings.Fields(message.CommandArguments())
+	if len(args) != 1 {
+		return t("Usage: /revoke <user_id|@username>")
+	}
+
+	return changeUserRole(message.From.ID, args[0], roleGuest)
+}
+
+// Changing the role of the user by the administrator
+func changeUserRole(adminID int64, arg, role string) string {
+	u, ok := findUser(arg)
+	if !ok {
+		return t("User not found: %s", arg)
+	}
+	// Administrators cannot take away their own rights by mistake
+	if u.ID == adminID {
+		return t("You cannot change your own role.")
+	}
+
+	setUserRole(u.ID, role)
+	if err := saveUsers(); err != nil {
+		logger.Errorf("Error saving users: %v", err)
+	}
+
+	logger.Infof("Administrator %d set the role of the user %d: %s", adminID, u.ID, role)
+	return t("The role of the user %d is now %s.", u.ID, role)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// SamplingParams Generation parameters of the request. Unset (nil) parameters are not sent,
+// then the values of the server or the model are used.
+type SamplingParams struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	MaxTokens        *int     `json:"max_tokens,omitempty"` // Length of the answer, the context is limited by TokenLimit
+	Stop             []string `json:"stop,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Seed             *int64   `json:"seed,omitempty"`
+}
+
+// samplingParam Description of a parameter for /settings and the GUI
+type samplingParam struct {
+	Name string
+	Hint string // Allowed values
+	// Getting the value as text ("" - not set)
+	get func(p *SamplingParams) string
+	// Setting the value from text ("" resets it)
+	set func(p *SamplingParams, value string) error
+}
+
+// Parameters in the order of display
+var samplingParams = []samplingParam{
+	floatParam("temperature", 0, 2, func(p *SamplingParams) **float64 { return &p.Temperature }),
+	floatParam("top_p", 0, 1, func(p *SamplingParams) **float64 { return &p.TopP }),
+	{
+		Name: "max_tokens",
+		Hint: "> 0",
+		get: func(p *SamplingParams) string {
+			if p.MaxTokens == nil {
+				return ""
+			}
+			return strconv.Itoa(*p.MaxTokens)
+		},
+		set: func(p *SamplingParams, value string) error {
+			if value == "" {
+				p.MaxTokens = nil
+				return nil
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("max_tokens must be a positive integer")
+			}
+			p.MaxTokens = &n
+			return nil
+		},
+	},
+	{
+		Name: "stop",
+		Hint: "a | b",
+		get: func(p *SamplingParams) string {
+			var parts []string
+			for _, s := range p.Stop {
+				parts = append(parts, strings.ReplaceAll(s, "\n", `\n`))
+			}
+			return strings.Join(parts, " | ")
+		},
+		set: func(p *SamplingParams, value string) error {
+			p.Stop = nil
+			for _, s := range strings.Split(value, "|") {
+				if s = strings.TrimSpace(s); s != "" {
+					p.Stop = append(p.Stop, strings.ReplaceAll(s, `\n`, "\n"))
+				}
+			}
+			// The API accepts up to 4 stop sequences
+			if len(p.Stop) > 4 {
+				return fmt.Errorf("no more than 4 stop sequences are allowed")
+			}
+			return nil
+		},
+	},
+	floatParam("presence_penalty", -2, 2, func(p *SamplingParams) **float64 { return &p.PresencePenalty }),
+	floatParam("frequency_penalty", -2, 2, func(p *SamplingParams) **float64 { return &p.FrequencyPenalty }),
+	{
+		Name: "seed",
+		Hint: "integer",
+		get: func(p *SamplingParams) string {
+			if p.Seed == nil {
+				return ""
+			}
+			return strconv.FormatInt(*p.Seed, 10)
+		},
+		set: func(p *SamplingParams, value string) error {
+			if value == "" {
+				p.Seed = nil
+				return nil
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("seed must be an integer")
+			}
+			p.Seed = &n
+			return nil
+		},
+	},
+}
+
+// Description of a numeric parameter with the range of values
+func floatParam(name string, lower, upper float64, field func(p *SamplingParams) **float64) samplingParam {
+	return samplingParam{
+		Name: name,
+		Hint: fmt.Sprintf("%g…%g", lower, upper),
+		get: func(p *SamplingParams) string {
+			if value := *field(p); value != nil {
+				return strconv.FormatFloat(*value, 'g', -1, 64)
+			}
+			return ""
+		},
+		set: func(p *SamplingParams, value string) error {
+			if value == "" {
+				*field(p) = nil
+				return nil
+			}
+			v, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+			if err != nil || v < lower || v > upper {
+				return fmt.Errorf("%s must be a number from %g to %g", name, lower, upper)
+			}
+			*field(p) = &v
+			return nil
+		},
+	}
+}
+
+// Search for the description of the parameter by name
+func findSamplingParam(name string) (samplingParam, bool) {
+	for _, param := range samplingParams {
+		if param.Name == name {
+			return param, true
+		}
+	}
+	return samplingParam{}, false
+}
+
+// Overriding the parameters by the parameters set in other
+func (p SamplingParams) merge(other SamplingParams) SamplingParams {
+	if other.Temperature != nil {
+		p.Temperature = other.Temperature
+	}
+	if other.TopP != nil {
+		p.TopP = other.TopP
+	}
+	if other.MaxTokens != nil {
+		p.MaxTokens = other.MaxTokens
+	}
+	if other.Stop != nil {
+		p.Stop = other.Stop
+	}
+	if other.PresencePenalty != nil {
+		p.PresencePenalty = other.PresencePenalty
+	}
+	if other.FrequencyPenalty != nil {
+		p.FrequencyPenalty = other.FrequencyPenalty
+	}
+	if other.Seed != nil {
+		p.Seed = other.Seed
+	}
+	return p
+}
+
+// Parameters of the requests of the chat: the configuration with the settings of the chat
+func chatSamplingParams(chatID int64) SamplingParams {
+	chatSettingsMutex.Lock()
+	defer chatSettingsMutex.Unlock()
+
+	params := config.SamplingParams
+	if s, ok := chatSettings[chatID]; ok {
+		params = params.merge(s.SamplingParams)
+	}
+	return params
+}
+
+// The /settings command: "/settings" shows the parameters of the chat, "/settings <name> <value>" sets one,
+// "/settings <name> default" returns the value of the configuration, "/settings reset" resets all of them
+func settingsCommand(message *tgbotapi.Message) string {
+	chatID := message.Chat.ID
+	args := strings.Fields(message.CommandArguments())
+
+	if len(args) == 0 {
+		return settingsText(chatID)
+	}
+	if !canChangeChatSettings(message) {
+		return t("Only the administrators of the group can change its settings.")
+	}
+
+	if len(args) == 1 && args[0] == "reset" {
+		if err := updateChatSettings(chatID, func(s *ChatSettings) {
+			s.SamplingParams = SamplingParams{}
+		}); err != nil {
+			logger.Errorf("Error saving chat settings: %v", err)
+		}
+		return t("The generation parameters of the chat are reset.")
+	}
+
+	name := strings.ToLower(args[0])
+	param, ok := findSamplingParam(name)
+	if !ok || len(args) < 2 {
+		return t("Usage: /settings <parameter> <value|default>, /settings reset") + "\n\n" + settingsText(chatID)
+	}
+
+	value := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(message.CommandArguments()), args[0]))
+	if value == "default" {
+		value = ""
+	}
+
+	var setErr error
+	var shown string
+	if err := updateChatSettings(chatID, func(s *ChatSettings) {
+		// The invalid value does not change the settings
+		updated := s.SamplingParams
+		if setErr = param.set(&updated, value); setErr == nil {
+			s.SamplingParams = updated
+			shown = param.get(&updated)
+		}
+	}); err != nil {
+		logger.Errorf("Error saving chat settings: %v", err)
+	}
+	if setErr != nil {
+		return t("Invalid value: %v", setErr)
+	}
+
+	logger.Infof("Chat %d set %s = %q", chatID, name, shown)
+	if shown == "" {
+		return t("%s: the default value is used.", name)
+	}
+	return t("%s is set to %s.", name, shown)
+}
+
+// The list of the parameters of the chat: the values of the chat are marked, the others are taken from the configuration
+func settingsText(chatID int64) string {
+	chatSettingsMutex.Lock()
+	var own SamplingParams
+	if s, ok := chatSettings[chatID]; ok {
+		own = s.SamplingParams
+	}
+	chatSettingsMutex.Unlock()
+
+	lines := []string{t("Generation parameters (%s - set for this chat):", "*")}
+	for _, param := range samplingParams {
+		value := param.get(&own)
+		mark := " *"
+		if value == "" {
+			value = param.get(&config.SamplingParams)
+			mark = ""
+		}
+		if value == "" {
+			value = t("model default")
+		}
+		lines = append(lines, fmt.Sprintf("%s = %s%s (%s)", param.Name, value, mark, param.Hint))
+	}
+	return strings.Join(lines, "\n")
+}
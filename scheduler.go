@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// generationJob A request to the model waiting for its turn
+type generationJob struct {
+	key         conversationKey // The conversation of the request, the queue status is sent to it
+	userID      int64           // The user who asked for the generation
+	run         func()
+	statusMsgID int // The message "you are #N in queue"
+	position    int // The position shown in the status message
+	started     bool
+	cancelled   bool // Removed from the queue by /stop
+}
+
+// generationScheduler Runs requests to the model: no more than the configured number at the same time
+// and strictly one after another within a conversation (FIFO)
+type generationScheduler struct {
+	mu      sync.Mutex
+	pending []*generationJob         // All waiting jobs in the order of arrival
+	busy    map[conversationKey]bool // Conversations with a running job
+	users   map[int64]int            // Waiting and running jobs of the users
+	running int
+}
+
+var scheduler = &generationScheduler{busy: make(map[conversationKey]bool), users: make(map[int64]int)}
+
+// The limit of simultaneous requests to the model
+func maxConcurrentRequests() int {
+	if config.MaxConcurrentRequests < 1 {
+		return 1
+	}
+	return config.MaxConcurrentRequests
+}
+
+// Adding a request of the user in the conversation to the queue. The request takes a place among
+// the requests in progress of the user; returns the explanation for the user if there are no free places.
+func enqueueGeneration(key conversationKey, userID int64, run func()) string {
+	limit := userQuota(userID).MaxConcurrent
+	job := &generationJob{key: key, userID: userID, run: run}
+
+	s := scheduler
+	s.mu.Lock()
+	if running := s.users[userID]; limit > 0 && running >= limit {
+		s.mu.Unlock()
+		return t("⏳ You already have %d requests in progress. Please wait until they finish.", running)
+	}
+	activeUpdates.Add(1)
+	s.pending = append(s.pending, job)
+	s.users[job.userID]++
+	started := s.dispatchLocked()
+	position := s.positionLocked(job)
+	job.position = position
+	s.mu.Unlock()
+
+	s.startJobs(started)
+
+	if position == 0 {
+		return ""
+	}
+
+	// The job waits: we tell the user their place in the queue
+	status := tgbotapi.NewMessage(key.ChatID, t("⏳ You are #%d in queue.", position))
+	sent, err := sendTo(key, status)
+	if err != nil {
+		logger.Errorf("Error sending queue status: %v", err)
+		return ""
+	}
+
+	s.mu.Lock()
+	// The job could start or be cancelled while the status was being sent
+	outdated := job.started || job.cancelled
+	if !outdated {
+		job.statusMsgID = sent.MessageID
+	}
+	s.mu.Unlock()
+
+	if outdated {
+		deleteQueueStatus(key.ChatID, sent.MessageID)
+	}
+	return ""
+}
+
+// Removing the waiting jobs of the conversation, returns false if there were none
+func cancelQueuedGenerations(key conversationKey) bool {
+	s := scheduler
+	s.mu.Lock()
+	// The status messages that are not sent yet are deleted by enqueueGeneration
+	var removed []generationJob
+	kept := s.pending[:0]
+	for _, job := range s.pending {
+		if key.contains(job.key) {
+			job.cancelled = true
+			removed = append(removed, *job)
+			s.releaseUserLocked(job.userID)
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.pending = kept
+	updates := s.positionUpdatesLocked()
+	s.mu.Unlock()
+
+	for _, job := range removed {
+		if job.statusMsgID != 0 {
+			deleteQueueStatus(job.key.ChatID, job.statusMsgID)
+		}
+		activeUpdates.Done()
+	}
+	showQueuePositions(updates)
+
+	return len(removed) > 0
+}
+
+// The number of waiting and running jobs of the user
+func (s *generationScheduler) userJobs(userID int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[userID]
+}
+
+// Forgetting a finished or cancelled job of the user
+func (s *generationScheduler) releaseUserLocked(userID int64) {
+	if s.users[userID]--; s.users[userID] <= 0 {
+		delete(s.users, userID)
+	}
+}
+
+// The position of the waiting job in the queue (0 if the job is already running)
+func (s *generationScheduler) positionLocked(job *generationJob) int {
+	for i, j := range s.pending {
+		if j == job {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Selection of the jobs that can be started now: the first waiting jobs of free conversations
+func (s *generationScheduler) dispatchLocked() []*generationJob {
+	var started []*generationJob
+	for i := 0; i < len(s.pending) && s.running < maxConcurrentRequests(); {
+		job := s.pending[i]
+		if s.busy[job.key] {
+			i++
+			continue
+		}
+
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+		s.busy[job.key] = true
+		s.running++
+		job.started = true
+		started = append(started, job)
+	}
+	return started
+}
+
+// Jobs whose position in the queue has changed
+func (s *generationScheduler) positionUpdatesLocked() []generationJob {
+	var updates []generationJob
+	for i, job := range s.pending {
+		if job.statusMsgID != 0 && job.position != i+1 {
+			job.position = i + 1
+			updates = append(updates, *job)
+		}
+	}
+	return updates
+}
+
+// Launch of the selected jobs
+func (s *generationScheduler) startJobs(jobs []*generationJob) {
+	for _, job := range jobs {
+		if job.statusMsgID != 0 {
+			deleteQueueStatus(job.key.ChatID, job.statusMsgID)
+		}
+		go s.runJob(job)
+	}
+}
+
+// Execution of the job and launch of the next ones
+func (s *generationScheduler) runJob(job *generationJob) {
+	defer activeUpdates.Done()
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Errorf("Generation of conversation %s failed: %v", job.key, r)
+			}
+		}()
+		job.run()
+	}()
+
+	s.mu.Lock()
+	s.running--
+	delete(s.busy, job.key)
+	s.releaseUserLocked(job.userID)
+	started := s.dispatchLocked()
+	updates := s.positionUpdatesLocked()
+	s.mu.Unlock()
+
+	s.startJobs(started)
+	showQueuePositions(updates)
+}
+
+// Updating the status messages with the new positions in the queue
+func showQueuePositions(updates []generationJob) {
+	for _, job := range updates {
+		edit := tgbotapi.NewEditMessageText(job.key.ChatID, job.statusMsgID, t("⏳ You are #%d in queue.", job.position))
+		if _, err := bot.Request(edit); err != nil {
+			logger.Debugf("Error updating queue status: %v", err)
+		}
+	}
+}
+
+// Removing the status message when the job has started
+func deleteQueueStatus(chatID int64, messageID int) {
+	if _, err := bot.Request(tgbotapi.NewDeleteMessage(chatID, messageID)); err != nil {
+		logger.Debugf("Error deleting queue status: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The tests of the scheduler check its races, run them with the race detector: go test -race
+
+// fakeTelegram A Telegram server that counts the methods called by the bot
+type fakeTelegram struct {
+	mu     sync.Mutex
+	calls  map[string]int
+	nextID int
+}
+
+func (f *fakeTelegram) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// Replacing the bot with one that talks to a fake server
+func useFakeTelegram(t *testing.T) *fakeTelegram {
+	t.Helper()
+	fake := &fakeTelegram{calls: make(map[string]int)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		fake.mu.Lock()
+		fake.calls[method]++
+		fake.nextID++
+		id := fake.nextID
+		fake.mu.Unlock()
+
+		// A slow network widens the windows between sending a status and saving its ID
+		time.Sleep(2 * time.Millisecond)
+		if method == "getMe" {
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"test_bot"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":` + strconv.Itoa(id) + `,"chat":{"id":1}}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	saved := bot
+	t.Cleanup(func() { bot = saved })
+	var err error
+	bot, err = tgbotapi.NewBotAPIWithClient("TOKEN", srv.URL+"/bot%s/%s", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+// A new empty scheduler with the limit of simultaneous requests
+func useScheduler(t *testing.T, limit int) {
+	t.Helper()
+	savedScheduler, savedLimit := scheduler, config.MaxConcurrentRequests
+	t.Cleanup(func() { scheduler, config.MaxConcurrentRequests = savedScheduler, savedLimit })
+	scheduler = &generationScheduler{busy: make(map[conversationKey]bool), users: make(map[int64]int)}
+	config.MaxConcurrentRequests = limit
+}
+
+func TestSchedulerOrderAndConcurrency(t *testing.T) {
+	useFakeTelegram(t)
+	useScheduler(t, 2)
+
+	var running, peak atomic.Int32
+	var mu sync.Mutex
+	order := make(map[conversationKey][]int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		key := chatConversation(int64(i % 3))
+		n := i
+		wg.Add(1)
+		denial := enqueueGeneration(key, int64(100+i), func() {
+			defer wg.Done()
+			for r := running.Add(1); ; {
+				if p := peak.Load(); r <= p || peak.CompareAndSwap(p, r) {
+					break
+				}
+			}
+			mu.Lock()
+			order[key] = append(order[key], n)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		})
+		if denial != "" {
+			t.Fatalf("job %d denied: %s", i, denial)
+		}
+	}
+	wg.Wait()
+	activeUpdates.Wait()
+
+	if p := peak.Load(); p > 2 {
+		t.Errorf("%d jobs ran at the same time, limit 2", p)
+	}
+	for key, jobs := range order {
+		for i := 1; i < len(jobs); i++ {
+			if jobs[i] < jobs[i-1] {
+				t.Errorf("conversation %s: jobs ran out of order: %v", key, jobs)
+				break
+			}
+		}
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	fake := useFakeTelegram(t)
+	useScheduler(t, 1)
+
+	block := make(chan struct{})
+	key := chatConversation(1)
+	other := chatConversation(2)
+
+	if denial := enqueueGeneration(key, 1, func() { <-block }); denial != "" {
+		t.Fatal(denial)
+	}
+
+	// Queued jobs are cancelled at the same time as their status messages are being sent
+	var ran atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enqueueGeneration(key, 2, func() { ran.Add(1) })
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	cancelled := make(chan bool)
+	go func() { cancelled <- cancelQueuedGenerations(key) }()
+	wg.Wait()
+	<-cancelled
+	cancelQueuedGenerations(key)
+
+	// The job of another conversation stays in the queue
+	var otherRan atomic.Bool
+	enqueueGeneration(other, 3, func() { otherRan.Store(true) })
+
+	close(block)
+	activeUpdates.Wait()
+
+	if n := ran.Load(); n != 0 {
+		t.Errorf("%d cancelled jobs ran", n)
+	}
+	if !otherRan.Load() {
+		t.Error("the job of another conversation did not run")
+	}
+	// Every status message is deleted: by the cancellation, by its sender or when the job starts
+	if sent, deleted := fake.count("sendMessage"), fake.count("deleteMessage"); sent != deleted {
+		t.Errorf("%d queue statuses were sent, %d deleted", sent, deleted)
+	}
+	if jobs := scheduler.userJobs(2); jobs != 0 {
+		t.Errorf("the user still has %d jobs", jobs)
+	}
+}
+
+func TestSchedulerUserLimit(t *testing.T) {
+	useFakeTelegram(t)
+	useScheduler(t, 4)
+
+	usersMutex.Lock()
+	savedUser, hadUser := users[42]
+	users[42] = &BotUser{ID: 42, Role: roleUser, Quota: &QuotaLimits{MaxConcurrent: 2}}
+	usersMutex.Unlock()
+	t.Cleanup(func() {
+		usersMutex.Lock()
+		defer usersMutex.Unlock()
+		if hadUser {
+			users[42] = savedUser
+		} else {
+			delete(users, 42)
+		}
+	})
+
+	block := make(chan struct{})
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if enqueueGeneration(chatConversation(int64(i)), 42, func() { <-block }) == "" {
+				accepted.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("%d jobs were accepted, limit 2", n)
+	}
+
+	close(block)
+	activeUpdates.Wait()
+
+	// The places are released when the jobs finish
+	if denial := enqueueGeneration(chatConversation(1), 42, func() {}); denial != "" {
+		t.Errorf("a new job is denied after the others finished: %s", denial)
+	}
+	activeUpdates.Wait()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Telegram gives bots files up to 20 MB
+	maxAudioSize         = 20 * 1024 * 1024
+	transcriptionTimeout = 5 * time.Minute
+)
+
+// audioRef A voice message or an audio file attached to a Telegram message
+type audioRef struct {
+	FileID   string
+	FileName string
+}
+
+// TranscriptionResponse The answer of the /audio/transcriptions endpoint
+type TranscriptionResponse struct {
+	Text string `json:"text"`
+}
+
+// The voice message or the audio file of the message
+func messageAudio(message *tgbotapi.Message) (audioRef, bool) {
+	if message.Voice != nil {
+		return audioRef{FileID: message.Voice.FileID, FileName: "voice.ogg"}, true
+	}
+
+	if audio := message.Audio; audio != nil {
+		name := audio.FileName
+		if name == "" {
+			name = "audio" + audioExtension(audio.MimeType)
+		}
+		return audioRef{FileID: audio.FileID, FileName: name}, true
+	}
+
+	return audioRef{}, false
+}
+
+// The file extension by the MIME type of the audio (the server recognizes the format by it)
+func audioExtension(mimeType string) string {
+	switch mimeType {
+	case "audio/mpeg", "audio/mp3":
+		return ".mp3"
+	case "audio/mp4", "audio/m4a", "audio/x-m4a":
+		return ".m4a"
+	case "audio/wav", "audio/x-wav":
+		return ".wav"
+	case "audio/flac":
+		return ".flac"
+	default:
+		return ".ogg"
+	}
+}
+
+// Speech recognition is enabled if the address of the server is set
+func transcriptionEnabled() bool {
+	return strings.TrimSpace(config.STTAddress) != ""
+}
+
+// Downloading the audio from Telegram and recognizing the speech
+func transcribeAudio(ref audioRef) (string, error) {
+	data, err := downloadTelegramFile(ref.FileID, maxAudioSize)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcriptionTimeout)
+	defer cancel()
+
+	return callTranscription(ctx, path.Base(ref.FileName), data)
+}
+
+// Request to the OpenAI-compatible /audio/transcriptions endpoint (for example, a local whisper server)
+func callTranscription(ctx context.Context, fileName string, audio []byte) (string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	part, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(audio); err != nil {
+		return "", err
+	}
+
+	fields := map[string]string{
+		"model":           config.STTModel,
+		"language":        config.STTLanguage,
+		"response_format": "json",
+	}
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := writer.WriteField(name, value); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	url := strings.TrimRight(config.STTAddress, "/") + "/audio/transcriptions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("transcription request error: %v", err)
+	}
+
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logger.Errorf("Error closing response: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("invalid status code: %d", resp.StatusCode)
+	}
+
+	var result TranscriptionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(result.Text), nil
+}
+
+// Showing the recognized text to the user in reply to the voice message
+func sendTranscript(key conversationKey, replyTo int, transcript string) {
+	// A long transcript is split into several messages, the first one replies to the voice message.
+	// It is sent as plain text: the speech of the user is not Markdown.
+	for i, part := range splitMessage("🎤 "+transcript, messagePartLimit) {
+		msg := tgbotapi.NewMessage(key.ChatID, part)
+		if i == 0 {
+			msg.ReplyToMessageID = replyTo
+		}
+		if _, err := sendTo(key, msg); err != nil {
+			logger.Errorf("Error sending transcript: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// streamRenderer Shows the answer being generated in Telegram messages.
+// Edits are batched by time and by the number of new characters, edits without changes are skipped,
+// and after error 429 no edits are made until the time specified by Telegram.
+// When the current message is full, the generation continues in a new message.
+type streamRenderer struct {
+	key        conversationKey
+	messageIDs []int
+	markup     tgbotapi.InlineKeyboardMarkup // Buttons while the answer is being generated
+
+	interval time.Duration
+	minChars int
+
+	lastText     string // The text of the current (last) message
+	lastEdit     time.Time
+	blockedUntil time.Time
+}
+
+// Creating the renderer; if there are no messageIDs, a new message will be sent
+func newStreamRenderer(key conversationKey, messageIDs []int, markup tgbotapi.InlineKeyboardMarkup) *streamRenderer {
+	interval := time.Duration(config.StreamEditInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	return &streamRenderer{
+		key:        key,
+		messageIDs: messageIDs,
+		markup:     markup,
+		interval:   interval,
+		minChars:   config.StreamEditMinChars,
+	}
+}
+
+// Sending the initial message (or resetting the existing ones) before the answer arrives
+func (r *streamRenderer) Start() error {
+	const placeholder = "..."
+
+	if len(r.messageIDs) > 0 {
+		// The previous answer could take several messages, only the first one remains
+		for _, id := range r.messageIDs[1:] {
+			_, _ = bot.Request(tgbotapi.NewDeleteMessage(r.key.ChatID, id))
+		}
+		r.messageIDs = r.messageIDs[:1]
+
+		edit := tgbotapi.NewEditMessageTextAndMarkup(r.key.ChatID, r.messageIDs[0], placeholder, r.markup)
+		if _, err := r.request(edit); err != nil {
+			logger.Errorf("Error editing message: %v", err)
+		}
+	} else {
+		msg := tgbotapi.NewMessage(r.key.ChatID, placeholder)
+		msg.ReplyMarkup = r.markup
+		sent, err := sendTo(r.key, msg)
+		if err != nil {
+			return err
+		}
+		r.messageIDs = []int{sent.MessageID}
+		// The "Stop" button of the message must find the conversation of the answer
+		rememberReplyChain(r.key, sent.MessageID)
+	}
+
+	r.lastText = placeholder
+	r.lastEdit = time.Now()
+	return nil
+}
+
+// Showing the current text of the answer, if enough time has passed and enough text has arrived
+func (r *streamRenderer) Update(text string) {
+	// The reasoning is not shown until the answer is ready
+	text = streamingText(text)
+	if len(r.messageIDs) == 0 || strings.TrimSpace(text) == "" {
+		return
+	}
+
+	now := time.Now()
+	if now.Before(r.blockedUntil) {
+		return
+	}
+
+	parts := splitMessage(text, messagePartLimit)
+
+	// The current message is full: we finish it and continue in a new message
+	if len(parts) > len(r.messageIDs) {
+		current := len(r.messageIDs) - 1
+		if _, err := deliverPart(r.key, r.messageIDs[current], parts[current], nil, r.request); err != nil {
+			logger.Debugf("Error editing stream message: %v", err)
+			return
+		}
+
+		id, err := deliverPart(r.key, 0, parts[current+1], &r.markup, r.request)
+		if err != nil {
+			logger.Debugf("Error sending stream message: %v", err)
+			return
+		}
+
+		r.messageIDs = append(r.messageIDs, id)
+		rememberReplyChain(r.key, id)
+		r.lastText = parts[current+1]
+		r.lastEdit = now
+		return
+	}
+
+	last := parts[len(parts)-1]
+	if len(parts) < len(r.messageIDs) || last == r.lastText {
+		return
+	}
+
+	elapsed := now.Sub(r.lastEdit)
+	newChars := utf8.RuneCountInString(last) - utf8.RuneCountInString(r.lastText)
+	// Small additions are shown only if the stream has slowed down
+	if elapsed < r.interval || (newChars < r.minChars && elapsed < 3*r.interval) {
+		return
+	}
+
+	r.lastEdit = now
+	if _, err := deliverPart(r.key, r.messageIDs[len(r.messageIDs)-1], last, &r.markup, r.request); err != nil {
+		logger.Debugf("Error editing stream message: %v", err)
+		return
+	}
+	r.lastText = last
+}
+
+// The final edit with the complete answer (it is repeated if Telegram asks to wait)
+func (r *streamRenderer) Finish(text string, markup *tgbotapi.InlineKeyboardMarkup) error {
+	if len(r.messageIDs) == 0 {
+		return errors.New("stream message was not sent")
+	}
+
+	if wait := time.Until(r.blockedUntil); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	ids, err := renderReply(r.key, r.messageIDs, text, markup)
+	if len(ids) > 0 {
+		r.messageIDs = ids
+	}
+	return err
+}
+
+// Request to Telegram that remembers the wait required by error 429
+func (r *streamRenderer) request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	resp, err := requestTo(r.key, c)
+	if err == nil || isMessageNotModified(err) {
+		return resp, nil
+	}
+
+	if retryAfter, limited := telegramRetryAfter(err); limited {
+		logger.Warnf("Telegram rate limit, edits are paused for %v", retryAfter)
+		r.blockedUntil = time.Now().Add(retryAfter)
+	}
+	return resp, err
+}
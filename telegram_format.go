@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+const (
+	parseModeHTML       = "HTML"
+	parseModeMarkdownV2 = "MarkdownV2"
+)
+
+var (
+	markdownParser = goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser()
+
+	// Characters that must be escaped in MarkdownV2
+	markdownV2Escaper = strings.NewReplacer(
+		`\`, `\\`, `_`, `\_`, `*`, `\*`, `[`, `\[`, `]`, `\]`, `(`, `\(`, `)`, `\)`, `~`, `\~`,
+		"`", "\\`", `>`, `\>`, `#`, `\#`, `+`, `\+`, `-`, `\-`, `=`, `\=`, `|`, `\|`,
+		`{`, `\{`, `}`, `\}`, `.`, `\.`, `!`, `\!`,
+	)
+	markdownV2CodeEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+	markdownV2LinkEscaper = strings.NewReplacer(`\`, `\\`, `)`, `\)`)
+	htmlEscaper           = strings.NewReplacer(`&`, `&amp;`, `<`, `&lt;`, `>`, `&gt;`, `"`, `&quot;`)
+)
+
+// The parse mode of the messages with answers: "HTML" (by default) or "MarkdownV2"
+func telegramParseMode() string {
+	if strings.EqualFold(config.ParseMode, parseModeMarkdownV2) {
+		return parseModeMarkdownV2
+	}
+	return parseModeHTML
+}
+
+// Converting the Markdown of the model into the text of a Telegram message and its parse mode.
+// The reasoning (<think> blocks) is shown above the answer according to the configured mode.
+func formatForTelegram(markdown string) (string, string) {
+	reasoning, answer, _ := splitReasoning(markdown)
+
+	parseMode := telegramParseMode()
+	source := []byte(answer)
+	doc := markdownParser.Parse(text.NewReader(source))
+
+	r := &telegramRenderer{source: source, html: parseMode == parseModeHTML}
+	result := strings.TrimSpace(r.blocks(doc))
+	if reasoning != "" && reasoningMode() != reasoningHide {
+		result = strings.TrimSpace(r.reasoning(reasoning) + "\n\n" + result)
+	}
+	if result == "" {
+		// The hidden reasoning must not get into the plain text
+		if reasoningMode() == reasoningHide {
+			return answerWithoutReasoning(markdown), ""
+		}
+		return markdown, ""
+	}
+
+	return result, parseMode
+}
+
+// telegramRenderer Rendering of the Markdown tree into Telegram HTML or MarkdownV2
+type telegramRenderer struct {
+	source []byte
+	html   bool
+}
+
+// Escaping of the plain text
+func (r *telegramRenderer) escape(s string) string {
+	if r.html {
+		return htmlEscaper.Replace(s)
+	}
+	return markdownV2Escaper.Replace(s)
+}
+
+// Wrapping the text in the markup of the style
+func (r *telegramRenderer) wrap(s, htmlTag, mdMark string) string {
+	if s == "" {
+		return ""
+	}
+	if r.html {
+		return "<" + htmlTag + ">" + s + "</" + htmlTag + ">"
+	}
+	return mdMark + s + mdMark
+}
+
+// Preformatted block (code, tables)
+func (r *telegramRenderer) pre(code, lang string) string {
+	code = strings.TrimRight(code, "\n")
+	if r.html {
+		if lang != "" {
+			return fmt.Sprintf(`<pre><code class="language-%s">%s</code></pre>`, htmlEscaper.Replace(lang), htmlEscaper.Replace(code))
+		}
+		return "<pre>" + htmlEscaper.Replace(code) + "</pre>"
+	}
+	return "```" + lang + "\n" + markdownV2CodeEscaper.Replace(code) + "\n```"
+}
+
+// Rendering of the child blocks of the node, separated by empty lines
+func (r *telegramRenderer) blocks(n ast.Node) string {
+	var parts []string
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if s := r.block(c); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// Rendering of a block node
+func (r *telegramRenderer) block(n ast.Node) string {
+	switch node := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		return r.inlines(node)
+	case *ast.Heading:
+		// Telegram has no headings, we show them in bold
+		return r.wrap(r.inlines(node), "b", "*")
+	case *ast.ThematicBreak:
+		return r.escape("———")
+	case *ast.FencedCodeBlock:
+		return r.pre(r.lines(node), string(node.Language(r.source)))
+	case *ast.CodeBlock:
+		return r.pre(r.lines(node), "")
+	case *ast.HTMLBlock:
+		return r.escape(strings.TrimRight(r.lines(node), "\n"))
+	case *ast.Blockquote:
+		return r.blockquote(r.blocks(node))
+	case *ast.List:
+		return r.list(node, 0)
+	case *east.Table:
+		return r.table(node)
+	default:
+		return r.blocks(node)
+	}
+}
+
+// Quote: <blockquote> in HTML, ">" at the beginning of lines in MarkdownV2
+func (r *telegramRenderer) blockquote(inner string) string {
+	if inner == "" {
+		return ""
+	}
+	if r.html {
+		return "<blockquote>" + inner + "</blockquote>"
+	}
+
+	lines := strings.Split(inner, "\n")
+	for i, line := range lines {
+		lines[i] = ">" + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// List with markers "•" or numbers, nested lists are indented
+func (r *telegramRenderer) list(list *ast.List, depth int) string {
+	indent := strings.Repeat("    ", depth)
+	number := list.Start
+	if number == 0 {
+		number = 1
+	}
+
+	var items []string
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		marker := "•"
+		if list.IsOrdered() {
+			marker = fmt.Sprintf("%d.", number)
+			number++
+		}
+
+		var content []string
+		for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+			if nested, ok := c.(*ast.List); ok {
+				content = append(content, r.list(nested, depth+1))
+				continue
+			}
+			if s := r.block(c); s != "" {
+				content = append(content, s)
+			}
+		}
+
+		body := strings.Join(content, "\n")
+		items = append(items, indent+r.escape(marker)+" "+body)
+	}
+
+	return strings.Join(items, "\n")
+}
+
+// Table as preformatted text with aligned columns
+func (r *telegramRenderer) table(table *east.Table) string {
+	var rows [][]string
+	var widths []int
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []string
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			value := strings.TrimSpace(r.plain(cell))
+			if i := len(cells); i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := utf8.RuneCountInString(value); w > widths[len(cells)] {
+				widths[len(cells)] = w
+			}
+			cells = append(cells, value)
+		}
+		rows = append(rows, cells)
+	}
+
+	var sb strings.Builder
+	for i, cells := range rows {
+		for j, value := range cells {
+			if j > 0 {
+				sb.WriteString(" | ")
+			}
+			sb.WriteString(value)
+			if j < len(cells)-1 {
+				sb.WriteString(strings.Repeat(" ", widths[j]-utf8.RuneCountInString(value)))
+			}
+		}
+		sb.WriteString("\n")
+
+		// A separator under the header
+		if _, isHeader := table.FirstChild().(*east.TableHeader); i == 0 && isHeader {
+			for j, w := range widths {
+				if j > 0 {
+					sb.WriteString("-+-")
+				}
+				sb.WriteString(strings.Repeat("-", w))
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	return r.pre(sb.String(), "")
+}
+
+// The text of the lines of a block node (code blocks)
+func (r *telegramRenderer) lines(n ast.Node) string {
+	var sb strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		sb.Write(segment.Value(r.source))
+	}
+	return sb.String()
+}
+
+// Rendering of the inline child nodes
+func (r *telegramRenderer) inlines(n ast.Node) string {
+	var sb strings.Builder
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		sb.WriteString(r.inline(c))
+	}
+	return sb.String()
+}
+
+// Rendering of an inline node
+func (r *telegramRenderer) inline(n ast.Node) string {
+	switch node := n.(type) {
+	case *ast.Text:
+		s := r.escape(string(node.Value(r.source)))
+		if node.SoftLineBreak() || node.HardLineBreak() {
+			s += "\n"
+		}
+		return s
+	case *ast.String:
+		return r.escape(string(node.Value))
+	case *ast.CodeSpan:
+		code := r.plain(node)
+		if r.html {
+			return "<code>" + htmlEscaper.Replace(code) + "</code>"
+		}
+		return "`" + markdownV2CodeEscaper.Replace(code) + "`"
+	case *ast.Emphasis:
+		if node.Level >= 2 {
+			return r.wrap(r.inlines(node), "b", "*")
+		}
+		return r.wrap(r.inlines(node), "i", "_")
+	case *east.Strikethrough:
+		return r.wrap(r.inlines(node), "s", "~")
+	case *ast.Link:
+		return r.link(string(node.Destination), r.inlines(node))
+	case *ast.AutoLink:
+		url := string(node.URL(r.source))
+		return r.link(url, r.escape(string(node.Label(r.source))))
+	case *ast.Image:
+		return r.link(string(node.Destination), r.escape(r.plain(node)))
+	case *ast.RawHTML:
+		var sb strings.Builder
+		for i := 0; i < node.Segments.Len(); i++ {
+			segment := node.Segments.At(i)
+			sb.Write(segment.Value(r.source))
+		}
+		return r.escape(sb.String())
+	case *east.TaskCheckBox:
+		if node.IsChecked {
+			return "☑ "
+		}
+		return "☐ "
+	default:
+		return r.inlines(node)
+	}
+}
+
+// Link; if the address is empty, only the text remains
+func (r *telegramRenderer) link(url, label string) string {
+	if label == "" {
+		label = r.escape(url)
+	}
+	if url == "" {
+		return label
+	}
+	if r.html {
+		return `<a href="` + htmlEscaper.Replace(url) + `">` + label + "</a>"
+	}
+	return "[" + label + "](" + markdownV2LinkEscaper.Replace(url) + ")"
+}
+
+// Plain text of the node without markup (table cells, code spans, image descriptions)
+func (r *telegramRenderer) plain(n ast.Node) string {
+	var sb strings.Builder
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch node := c.(type) {
+		case *ast.Text:
+			sb.Write(node.Value(r.source))
+			if node.SoftLineBreak() || node.HardLineBreak() {
+				sb.WriteString(" ")
+			}
+		case *ast.String:
+			sb.Write(node.Value)
+		default:
+			sb.WriteString(r.plain(node))
+		}
+	}
+	return sb.String()
+}
+
+// Telegram could not parse the markup of the message
+func isParseError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't parse entities")
+}
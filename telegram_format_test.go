@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestFormatForTelegram(t *testing.T) {
+	table := "| Name | Qty |\n|---|---|\n| apple | 10 |\n| kiwi | 2 |"
+	list := "- one\n- two\n    - nested\n- three"
+
+	tests := []struct {
+		name     string
+		markdown string
+		html     string
+		mdv2     string
+	}{
+		{"plain text", "Hello, world!", "Hello, world!", `Hello, world\!`},
+		{"heading", "# Title", "<b>Title</b>", "*Title*"},
+		{"emphasis", "**bold** and _italic_ and ~~gone~~", "<b>bold</b> and <i>italic</i> and <s>gone</s>", "*bold* and _italic_ and ~gone~"},
+		{"special characters", "a < b && c > d", "a &lt; b &amp;&amp; c &gt; d", `a < b && c \> d`},
+		{"punctuation", "1 + 1 = 2. (yes)!", "1 + 1 = 2. (yes)!", `1 \+ 1 \= 2\. \(yes\)\!`},
+		{"nested list", list, "• one\n• two\n    • nested\n• three", "• one\n• two\n    • nested\n• three"},
+		{"ordered list", "1. first\n2. second", "1. first\n2. second", "1\\. first\n2\\. second"},
+		{"link with parentheses", "[docs](https://example.com/a_(b))", `<a href="https://example.com/a_(b)">docs</a>`, `[docs](https://example.com/a_(b\))`},
+		{"autolink", "<https://example.com>", `<a href="https://example.com">https://example.com</a>`, `[https://example\.com](https://example.com)`},
+		{"raw inline HTML", "<b>raw</b> html", "&lt;b&gt;raw&lt;/b&gt; html", `<b\>raw</b\> html`},
+		{"HTML block", "<div>\nblock\n</div>", "&lt;div&gt;\nblock\n&lt;/div&gt;", "<div\\>\nblock\n</div\\>"},
+		{"code span", "`a<b`", "<code>a&lt;b</code>", "`a<b`"},
+		{"code block", "```go\nx := `a`\n```", "<pre><code class=\"language-go\">x := `a`</code></pre>", "```go\nx := \\`a\\`\n```"},
+		{"table", table, "<pre>Name  | Qty\n------+----\napple | 10\nkiwi  | 2</pre>", "```\nName  | Qty\n------+----\napple | 10\nkiwi  | 2\n```"},
+		{"quote", "> quoted *text*", "<blockquote>quoted <i>text</i></blockquote>", ">quoted _text_"},
+	}
+
+	saved := config.ParseMode
+	defer func() { config.ParseMode = saved }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for mode, want := range map[string]string{parseModeHTML: tt.html, parseModeMarkdownV2: tt.mdv2} {
+				config.ParseMode = mode
+				got, parseMode := formatForTelegram(tt.markdown)
+				if got != want || parseMode != mode {
+					t.Errorf("%s: got %q (%s), want %q", mode, got, parseMode, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatForTelegramEmpty(t *testing.T) {
+	got, parseMode := formatForTelegram("")
+	if got != "" || parseMode != "" {
+		t.Errorf("got %q (%q), want an empty text without a parse mode", got, parseMode)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	tokenCalibrationFile = "token_calibration.json"
+	// Service tokens of the chat template for each message and for the whole request
+	messageTokenOverhead = 4
+	requestTokenOverhead = 3
+	// Rough cost of an image: depending on the model, it takes from several hundred to a thousand tokens
+	imageTokenEstimate = 768
+	// Weight of a new observation in the calibration factor
+	calibrationAlpha = 0.3
+	// The size of the cache of tokenized words of the BPE tokenizer
+	bpeCacheSize = 50000
+)
+
+// Tokenizer Counting the tokens of a text
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+var (
+	tokenizer Tokenizer = approxTokenizer{}
+
+	// Calibration factors by models: real number of tokens / estimate of the tokenizer
+	tokenCalibration      = make(map[string]float64)
+	tokenCalibrationMutex sync.Mutex
+)
+
+// Initialization of the tokenizer by the configuration: "approx" (by default) or "bpe"
+func initTokenizer() {
+	switch config.Tokenizer {
+	case "bpe":
+		bpe, err := loadBPETokenizer(config.TokenizerFile)
+		if err != nil {
+			logger.Errorf("Error loading tokenizer %s, the approximate tokenizer will be used: %v", config.TokenizerFile, err)
+			tokenizer = approxTokenizer{}
+			break
+		}
+		tokenizer = bpe
+		logger.Infof("BPE tokenizer loaded: %s (%d tokens in vocabulary)", config.TokenizerFile, len(bpe.vocab))
+	case "", "approx":
+		tokenizer = approxTokenizer{}
+	default:
+		logger.Warnf("Unknown tokenizer '%s', the approximate tokenizer will be used", config.Tokenizer)
+		tokenizer = approxTokenizer{}
+	}
+
+	if err := loadTokenCalibration(); err != nil {
+		logger.Errorf("Error loading token calibration: %v", err)
+	}
+}
+
+// Estimation of the number of tokens of messages for the model, taking into account the calibration
+func estimateTokens(model string, messages ...LMMessage) int {
+	raw := rawTokenCount(messages)
+
+	tokenCalibrationMutex.Lock()
+	factor, ok := tokenCalibration[model]
+	tokenCalibrationMutex.Unlock()
+
+	if !ok {
+		return raw
+	}
+	return int(math.Ceil(float64(raw) * factor))
+}
+
+// Number of tokens by the tokenizer without the calibration
+func rawTokenCount(messages []LMMessage) int {
+	total := 0
+	for _, m := range messages {
+		total += tokenizer.CountTokens(m.Content) + messageTokenOverhead + len(m.Images)*imageTokenEstimate
+	}
+	return total
+}
+
+// Refinement of the calibration factor of the model by the real number of prompt tokens
+func calibrateTokenizer(model string, conversation []LMMessage, promptTokens int) {
+	if promptTokens <= 0 || len(conversation) == 0 {
+		return
+	}
+	// The tokens of images do not depend on the tokenizer, such requests are not used for the calibration
+	for _, m := range conversation {
+		if len(m.Images) > 0 {
+			return
+		}
+	}
+
+	raw := rawTokenCount(conversation) + requestTokenOverhead
+	ratio := float64(promptTokens) / float64(raw)
+	// We discard implausible values (for example, if the server cached the prompt)
+	if ratio < 0.25 || ratio > 4 {
+		logger.Debugf("Token calibration skipped for %s: ratio %.2f", model, ratio)
+		return
+	}
+
+	tokenCalibrationMutex.Lock()
+	factor, ok := tokenCalibration[model]
+	if ok {
+		factor = factor*(1-calibrationAlpha) + ratio*calibrationAlpha
+	} else {
+		factor = ratio
+	}
+	tokenCalibration[model] = factor
+	tokenCalibrationMutex.Unlock()
+
+	logger.Debugf("Token calibration for %s: prompt_tokens=%d, estimate=%d, factor=%.3f", model, promptTokens, raw, factor)
+
+	if err := saveTokenCalibration(); err != nil {
+		logger.Errorf("Error saving token calibration: %v", err)
+	}
+}
+
+// Loading calibration factors from a file
+func loadTokenCalibration() error {
+	tokenCalibrationMutex.Lock()
+	defer tokenCalibrationMutex.Unlock()
+
+	data, err := os.ReadFile(tokenCalibrationFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &tokenCalibration)
+}
+
+// Saving calibration factors to a file
+func saveTokenCalibration() error {
+	tokenCalibrationMutex.Lock()
+	defer tokenCalibrationMutex.Unlock()
+
+	data, err := json.MarshalIndent(tokenCalibration, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(tokenCalibrationFile, data, 0644)
+}
+
+// --------------------------
+// Approximate tokenizer (by classes of characters)
+// --------------------------
+
+// approxTokenizer Estimates tokens by the number of characters of each script:
+// Latin words are usually 4 characters per token, Cyrillic and other alphabets are 2-3,
+// CJK characters are about one token each, punctuation and symbols are one token each.
+type approxTokenizer struct{}
+
+// Character classes of the approximate tokenizer
+const (
+	charSpace = iota
+	charLatin
+	charAlphabet
+	charDigit
+	charCJK
+	charSymbol
+)
+
+// Average number of characters per token for the runs of a class
+var approxCharsPerToken = map[int]float64{
+	charLatin:    4,
+	charAlphabet: 2.5,
+	charDigit:    2,
+}
+
+func (approxTokenizer) CountTokens(text string) int {
+	tokens := 0.0
+	runClass, runLength := charSpace, 0
+
+	flush := func() {
+		if perToken, ok := approxCharsPerToken[runClass]; ok && runLength > 0 {
+			tokens += math.Ceil(float64(runLength) / perToken)
+		}
+		runLength = 0
+	}
+
+	for _, r := range text {
+		class := classifyRune(r)
+		switch class {
+		case charSpace:
+			flush()
+			if r == '\n' {
+				tokens++
+			}
+		case charCJK, charSymbol:
+			flush()
+			tokens++
+		default:
+			if class != runClass {
+				flush()
+			}
+			runLength++
+		}
+		runClass = class
+	}
+	flush()
+
+	return int(tokens)
+}
+
+// Class of the character for the approximate tokenizer
+func classifyRune(r rune) int {
+	switch {
+	case unicode.IsSpace(r):
+		return charSpace
+	case unicode.IsDigit(r):
+		return charDigit
+	case r < utf8.RuneSelf && unicode.IsLetter(r), unicode.Is(unicode.Latin, r):
+		return charLatin
+	case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+		return charCJK
+	case unicode.IsLetter(r), unicode.IsMark(r):
+		return charAlphabet
+	default:
+		return charSymbol
+	}
+}
+
+// --------------------------
+// BPE tokenizer (from tokenizer.json of the model)
+// --------------------------
+
+// Pre-tokenization of byte-level BPE (GPT-2/Llama 3/Qwen), without lookahead which is not supported by regexp
+var bpePreTokenizeRe = regexp.MustCompile(`'(?i:s|t|re|ve|m|ll|d)| ?\p{L}+| ?\p{N}{1,3}| ?[^\s\p{L}\p{N}]+|\s+`)
+
+type bpeTokenizer struct {
+	vocab     map[string]int
+	ranks     map[[2]string]int
+	byteLevel bool // byte-level BPE (Ġ) or SentencePiece BPE (▁ and byte fallback)
+
+	cacheMutex sync.Mutex
+	cache      map[string]int
+}
+
+// The structure of the required part of tokenizer.json (Hugging Face format)
+type tokenizerFile struct {
+	Model struct {
+		Type   string            `json:"type"`
+		Vocab  map[string]int    `json:"vocab"`
+		Merges []json.RawMessage `json:"merges"`
+	} `json:"model"`
+	Decoder json.RawMessage `json:"decoder"`
+}
+
+// Loading the BPE tokenizer from the tokenizer.json file
+func loadBPETokenizer(fileName string) (*bpeTokenizer, error) {
+	if fileName == "" {
+		return nil, fmt.Errorf("tokenizer file is not specified")
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokenizerFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing tokenizer: %v", err)
+	}
+
+	if file.Model.Type != "" && file.Model.Type != "BPE" {
+		return nil, fmt.Errorf("unsupported tokenizer model: %s", file.Model.Type)
+	}
+	if len(file.Model.Vocab) == 0 {
+		return nil, fmt.Errorf("tokenizer vocabulary is empty")
+	}
+
+	ranks := make(map[[2]string]int, len(file.Model.Merges))
+	for i, raw := range file.Model.Merges {
+		// Merges are stored either as "a b" or as ["a", "b"]
+		var pair [2]string
+		var line string
+		if err := json.Unmarshal(raw, &line); err == nil {
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			pair = [2]string{parts[0], parts[1]}
+		} else if err := json.Unmarshal(raw, &pair); err != nil {
+			return nil, fmt.Errorf("error parsing merge %d: %v", i, err)
+		}
+
+		if _, exists := ranks[pair]; !exists {
+			ranks[pair] = i
+		}
+	}
+
+	return &bpeTokenizer{
+		vocab:     file.Model.Vocab,
+		ranks:     ranks,
+		byteLevel: bytes.Contains(file.Decoder, []byte(`"ByteLevel"`)),
+		cache:     make(map[string]int),
+	}, nil
+}
+
+func (b *bpeTokenizer) CountTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+
+	total := 0
+	if !b.byteLevel {
+		// SentencePiece: spaces are replaced with ▁ and the text begins with it
+		for _, word := range sentencePieceWords("▁" + strings.ReplaceAll(text, " ", "▁")) {
+			total += b.countWord(word)
+		}
+		return total
+	}
+
+	for _, word := range bpePreTokenizeRe.FindAllString(text, -1) {
+		total += b.countWord(byteLevelEncode(word))
+	}
+	return total
+}
+
+// Splitting the text of SentencePiece into words: each word begins with its spaces (▁),
+// a line break is a separate word (merges almost never cross these boundaries)
+func sentencePieceWords(text string) []string {
+	var words []string
+	start := 0
+	prev := rune(0)
+	for i, r := range text {
+		if i > start && ((r == '▁' && prev != '▁') || r == '\n' || prev == '\n') {
+			words = append(words, text[start:i])
+			start = i
+		}
+		prev = r
+	}
+	if start < len(text) {
+		words = append(words, text[start:])
+	}
+	return words
+}
+
+// The number of tokens of one pre-tokenized word (with cache)
+func (b *bpeTokenizer) countWord(word string) int {
+	b.cacheMutex.Lock()
+	if n, ok := b.cache[word]; ok {
+		b.cacheMutex.Unlock()
+		return n
+	}
+	b.cacheMutex.Unlock()
+
+	n := 0
+	for _, symbol := range b.merge(word) {
+		if _, ok := b.vocab[symbol]; ok || b.byteLevel {
+			n++
+		} else {
+			// Byte fallback: an unknown symbol is encoded by its bytes
+			n += len(symbol)
+		}
+	}
+
+	b.cacheMutex.Lock()
+	if len(b.cache) >= bpeCacheSize {
+		b.cache = make(map[string]int)
+	}
+	b.cache[word] = n
+	b.cacheMutex.Unlock()
+
+	return n
+}
+
+// Applying BPE merges to the word in the order of their ranks
+func (b *bpeTokenizer) merge(word string) []string {
+	var symbols []string
+	for _, r := range word {
+		symbols = append(symbols, string(r))
+	}
+
+	for len(symbols) > 1 {
+		bestRank, bestIndex := math.MaxInt, -1
+		for i := 0; i < len(symbols)-1; i++ {
+			if rank, ok := b.ranks[[2]string{symbols[i], symbols[i+1]}]; ok && rank < bestRank {
+				bestRank, bestIndex = rank, i
+			}
+		}
+		if bestIndex < 0 {
+			break
+		}
+
+		first, second := symbols[bestIndex], symbols[bestIndex+1]
+		merged := symbols[:0:0]
+		for i := 0; i < len(symbols); i++ {
+			if i < len(symbols)-1 && symbols[i] == first && symbols[i+1] == second {
+				merged = append(merged, first+second)
+				i++
+				continue
+			}
+			merged = append(merged, symbols[i])
+		}
+		symbols = merged
+	}
+
+	return symbols
+}
+
+// Table of GPT-2 bytes to printable characters
+var byteLevelTable = func() [256]rune {
+	var table [256]rune
+	n := 0
+	for i := 0; i < 256; i++ {
+		if (i >= '!' && i <= '~') || (i >= 0xA1 && i <= 0xAC) || (i >= 0xAE && i <= 0xFF) {
+			table[i] = rune(i)
+		} else {
+			table[i] = rune(256 + n)
+			n++
+		}
+	}
+	return table
+}()
+
+// Encoding the bytes of the word by the characters of byte-level BPE
+func byteLevelEncode(word string) string {
+	var sb strings.Builder
+	for i := 0; i < len(word); i++ {
+		sb.WriteRune(byteLevelTable[word[i]])
+	}
+	return sb.String()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+func TestApproxTokenizer(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hello", 2},     // 5 Latin characters, 4 per token
+		{"привет", 3},    // 6 Cyrillic characters, 2.5 per token
+		{"你好", 2},        // one token per CJK character
+		{"a, b", 3},      // the comma is a separate token
+		{"123456", 3},    // 2 digits per token
+		{"one\ntwo", 3},  // the line break is a token
+		{"hello мир", 4}, // the scripts are counted separately
+	}
+
+	for _, tt := range tests {
+		if got := (approxTokenizer{}).CountTokens(tt.text); got != tt.want {
+			t.Errorf("CountTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestBPETokenizer(t *testing.T) {
+	tests := []struct {
+		file      string
+		byteLevel bool
+		counts    map[string]int
+	}{
+		{
+			file:      "testdata/tokenizer_bytelevel.json",
+			byteLevel: true,
+			counts: map[string]int{
+				"":             0,
+				"hello":        1,
+				"hello world":  2,
+				"hello world!": 3,
+				"world":        3, // "world" without the space has no merges to a single token: w, or, ld
+			},
+		},
+		{
+			file:      "testdata/tokenizer_sentencepiece.json",
+			byteLevel: false,
+			counts: map[string]int{
+				"":                  0,
+				"hello":             1,
+				"hello world":       2,
+				"hello world hello": 3,
+				"hello é":           4, // ▁hello, ▁ and the 2 bytes of the unknown character
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		bpe, err := loadBPETokenizer(tt.file)
+		if err != nil {
+			t.Fatalf("loading %s: %v", tt.file, err)
+		}
+		if bpe.byteLevel != tt.byteLevel {
+			t.Errorf("%s: byteLevel = %v, want %v", tt.file, bpe.byteLevel, tt.byteLevel)
+		}
+		for text, want := range tt.counts {
+			if got := bpe.CountTokens(text); got != want {
+				t.Errorf("%s: CountTokens(%q) = %d, want %d", tt.file, text, got, want)
+			}
+		}
+	}
+}
+
+func TestLoadBPETokenizerErrors(t *testing.T) {
+	if _, err := loadBPETokenizer(""); err == nil {
+		t.Error("no file: want an error")
+	}
+	if _, err := loadBPETokenizer("testdata/missing.json"); err == nil {
+		t.Error("missing file: want an error")
+	}
+}
+
+func TestSentencePieceWords(t *testing.T) {
+	got := sentencePieceWords("▁Hello▁▁world\n\nfoo▁bar")
+	want := []string{"▁Hello", "▁▁world", "\n", "\n", "foo", "▁bar"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestCalibrateTokenizer(t *testing.T) {
+	chdirTemp(t)
+
+	savedTokenizer, savedCalibration := tokenizer, tokenCalibration
+	defer func() { tokenizer, tokenCalibration = savedTokenizer, savedCalibration }()
+	tokenizer = approxTokenizer{}
+	tokenCalibration = make(map[string]float64)
+
+	const model = "test-model"
+	conversation := []LMMessage{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "How many tokens are in this question?"},
+	}
+	raw := rawTokenCount(conversation)
+	request := raw + requestTokenOverhead
+
+	factor := func() float64 {
+		tokenCalibrationMutex.Lock()
+		defer tokenCalibrationMutex.Unlock()
+		return tokenCalibration[model]
+	}
+	assertFactor := func(step string, want float64) {
+		t.Helper()
+		if got := factor(); math.Abs(got-want) > 1e-9 {
+			t.Fatalf("%s: factor = %v, want %v", step, got, want)
+		}
+	}
+
+	if got := estimateTokens(model, conversation...); got != raw {
+		t.Fatalf("estimate without calibration = %d, want %d", got, raw)
+	}
+
+	// The first observation is taken as is
+	calibrateTokenizer(model, conversation, 2*request)
+	assertFactor("first observation", 2)
+	if got, want := estimateTokens(model, conversation...), int(math.Ceil(float64(raw)*2)); got != want {
+		t.Errorf("estimate = %d, want %d", got, want)
+	}
+
+	// The next ones are mixed in with the weight calibrationAlpha
+	calibrateTokenizer(model, conversation, request)
+	assertFactor("second observation", 2*(1-calibrationAlpha)+calibrationAlpha)
+	expected := factor()
+
+	// Implausible values, empty requests and requests with images are ignored
+	calibrateTokenizer(model, conversation, 10*request)
+	calibrateTokenizer(model, conversation, 0)
+	calibrateTokenizer(model, nil, request)
+	withImage := append([]LMMessage{}, conversation...)
+	withImage[1].Images = []string{"data:image/png;base64,AAAA"}
+	calibrateTokenizer(model, withImage, 3*request)
+	assertFactor("ignored observations", expected)
+
+	// The factors are saved and loaded again
+	tokenCalibration = make(map[string]float64)
+	if err := loadTokenCalibration(); err != nil {
+		t.Fatal(err)
+	}
+	assertFactor("after loading", expected)
+
+	if _, err := os.Stat(tokenCalibrationFile); err != nil {
+		t.Errorf("the calibration file is not saved: %v", err)
+	}
+}
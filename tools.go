@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// How many times in a row the model may call tools before the final answer
+	maxToolRounds = 5
+	// How many tools the model may call in one answer
+	maxToolCalls = 16
+	// The largest file that the read_file tool returns
+	maxToolFileSize = 64 * 1024
+)
+
+// ToolHandler Execution of a tool: receives the JSON arguments from the model and returns the result for it
+type ToolHandler func(ctx context.Context, args json.RawMessage) (string, error)
+
+// Tool A Go function available to the model
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  string // JSON schema of the arguments
+	Handler     ToolHandler
+}
+
+// Registered tools by name
+var toolRegistry = make(map[string]*Tool)
+
+func init() {
+	registerTool(&Tool{
+		Name:        "current_time",
+		Description: "Returns the current date and time. Optionally in the given IANA time zone.",
+		Parameters: `{"type":"object","properties":{` +
+			`"timezone":{"type":"string","description":"IANA time zone, for example Europe/Moscow"}}}`,
+		Handler: currentTimeTool,
+	})
+	registerTool(&Tool{
+		Name:        "calculator",
+		Description: "Evaluates an arithmetic expression. Supports + - * / % ^, parentheses, pi, e and the functions sqrt, abs, exp, ln, log10, sin, cos, tan, round, floor, ceil.",
+		Parameters: `{"type":"object","properties":{` +
+			`"expression":{"type":"string","description":"The expression, for example (2+3)*sqrt(16)"}},"required":["expression"]}`,
+		Handler: calculatorTool,
+	})
+	registerTool(&Tool{
+		Name:        "list_files",
+		Description: "Lists the files available to the read_file tool.",
+		Parameters: `{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"Subdirectory, empty for the root"}}}`,
+		Handler: listFilesTool,
+	})
+	registerTool(&Tool{
+		Name:        "read_file",
+		Description: "Reads a text file from the local file folder of the bot.",
+		Parameters: `{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"Path of the file relative to the folder"}},"required":["path"]}`,
+		Handler: readFileTool,
+	})
+}
+
+// Registration of a tool (a tool with the same name is replaced)
+func registerTool(tool *Tool) {
+	toolRegistry[tool.Name] = tool
+}
+
+// Descriptions of the tools enabled in the configuration for the request
+func enabledTools() []LMTool {
+	var tools []LMTool
+	for _, name := range config.Tools {
+		tool, ok := toolRegistry[name]
+		if !ok {
+			logger.Warnf("Unknown tool in the configuration: %s", name)
+			continue
+		}
+		if (name == "read_file" || name == "list_files") && config.ToolsDir == "" {
+			continue
+		}
+
+		tools = append(tools, LMTool{
+			Type: "function",
+			Function: LMFunctionDef{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  json.RawMessage(tool.Parameters),
+			},
+		})
+	}
+	return tools
+}
+
+// Names of all registered tools
+func toolNames() []string {
+	var names []string
+	for name := range toolRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Adding the request of the model and the results of the called tools to the conversation
+func appendToolResults(ctx context.Context, conversation []LMMessage, message LMMessage) []LMMessage {
+	for i := range message.ToolCalls {
+		if message.ToolCalls[i].ID == "" {
+			message.ToolCalls[i].ID = fmt.Sprintf("call_%d", i)
+		}
+	}
+
+	result := append(copyMessages(conversation), message)
+	for _, call := range message.ToolCalls {
+		result = append(result, LMMessage{
+			Role:       "tool",
+			ToolCallID: call.ID,
+			Content:    runToolCall(ctx, call),
+		})
+	}
+	return result
+}
+
+// Execution of a tool call; errors are returned to the model as the result
+func runToolCall(ctx context.Context, call LMToolCall) string {
+	tool, ok := toolRegistry[call.Function.Name]
+	enabled := false
+	for _, name := range config.Tools {
+		enabled = enabled || name == call.Function.Name
+	}
+	if !ok || !enabled {
+		return fmt.Sprintf("Error: unknown tool %q", call.Function.Name)
+	}
+
+	args := json.RawMessage(call.Function.Arguments)
+	if strings.TrimSpace(call.Function.Arguments) == "" {
+		args = json.RawMessage("{}")
+	}
+
+	result, err := tool.Handler(ctx, args)
+	if err != nil {
+		logger.Warnf("Tool %s failed: %v", tool.Name, err)
+		return "Error: " + err.Error()
+	}
+
+	logger.Debugf("Tool %s(%s): %s", tool.Name, call.Function.Arguments, result)
+	return result
+}
+
+// --------------------------
+// Built-in tools
+// --------------------------
+
+// Tool current_time: the current time, optionally in the given time zone
+func currentTimeTool(_ context.Context, args json.RawMessage) (string, error) {
+	var params struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	now := time.Now()
+	if params.Timezone != "" {
+		location, err := time.LoadLocation(params.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown time zone: %s", params.Timezone)
+		}
+		now = now.In(location)
+	}
+
+	return now.Format("Monday, 2006-01-02 15:04:05 MST (-07:00)"), nil
+}
+
+// Tool calculator: evaluation of an arithmetic expression
+func calculatorTool(_ context.Context, args json.RawMessage) (string, error) {
+	var params struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	value, err := evaluateExpression(params.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64), nil
+}
+
+// Tool list_files: files of the folder of the tools
+func listFilesTool(_ context.Context, args json.RawMessage) (string, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	dir, err := sandboxPath(params.Path)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", errors.New("the directory cannot be read")
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		lines = append(lines, name)
+	}
+	if len(lines) == 0 {
+		return "The directory is empty.", nil
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Tool read_file: the text of a file of the folder of the tools
+func readFileTool(_ context.Context, args json.RawMessage) (string, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	path, err := sandboxPath(params.Path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return "", errors.New("the file does not exist")
+	}
+	if info.Size() > maxToolFileSize {
+		return "", fmt.Errorf("the file is larger than %d bytes", maxToolFileSize)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.New("the file cannot be read")
+	}
+	return extractDocumentText(path, "", data)
+}
+
+// The path inside the folder of the tools; paths leading outside the folder are refused
+func sandboxPath(rel string) (string, error) {
+	if config.ToolsDir == "" {
+		return "", errors.New("the file folder is not configured")
+	}
+
+	root, err := filepath.Abs(config.ToolsDir)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+
+	path := filepath.Join(root, filepath.FromSlash(filepath.Clean("/"+rel)))
+	// Symbolic links must not lead outside the folder either
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	inside, err := filepath.Rel(root, path)
+	if err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", errors.New("access outside the file folder is denied")
+	}
+	return path, nil
+}
+
+// --------------------------
+// Calculator
+// --------------------------
+
+// expressionParser Recursive descent parser of arithmetic expressions
+type expressionParser struct {
+	input []rune
+	pos   int
+}
+
+// Evaluation of an arithmetic expression
+func evaluateExpression(expression string) (float64, error) {
+	p := &expressionParser{input: []rune(expression)}
+	value, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("the result is not a finite number")
+	}
+	return value, nil
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// The next character is op (it is consumed)
+func (p *expressionParser) accept(op rune) bool {
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// sum = product { ("+" | "-") product }
+func (p *expressionParser) parseSum() (float64, error) {
+	value, err := p.parseProduct()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('+'):
+			right, err := p.parseProduct()
+			if err != nil {
+				return 0, err
+			}
+			value += right
+		case p.accept('-'):
+			right, err := p.parseProduct()
+			if err != nil {
+				return 0, err
+			}
+			value -= right
+		default:
+			return value, nil
+		}
+	}
+}
+
+// product = unary { ("*" | "/" | "%") unary }
+func (p *expressionParser) parseProduct() (float64, error) {
+	value, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('*'):
+			right, err := p.parseUnary()
+			if err != nil {
+				return 0, err
+			}
+			value *= right
+		case p.accept('/'):
+			right, err := p.parseUnary()
+			if err != nil {
+				return 0, err
+			}
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			value /= right
+		case p.accept('%'):
+			right, err := p.parseUnary()
+			if err != nil {
+				return 0, err
+			}
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			value = math.Mod(value, right)
+		default:
+			return value, nil
+		}
+	}
+}
+
+// unary = ("-" | "+") unary | power
+func (p *expressionParser) parseUnary() (float64, error) {
+	if p.accept('-') {
+		value, err := p.parseUnary()
+		return -value, err
+	}
+	if p.accept('+') {
+		return p.parseUnary()
+	}
+	return p.parsePower()
+}
+
+// power = primary [ "^" unary ]
+func (p *expressionParser) parsePower() (float64, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return 0, err
+	}
+	if p.accept('^') {
+		exponent, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exponent), nil
+	}
+	return base, nil
+}
+
+// primary = number | constant | function "(" sum ")" | "(" sum ")"
+func (p *expressionParser) parsePrimary() (float64, error) {
+	p.skipSpaces()
+	if p.accept('(') {
+		value, err := p.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, errors.New("missing closing parenthesis")
+		}
+		return value, nil
+	}
+
+	start := p.pos
+	if p.pos < len(p.input) && unicode.IsLetter(p.input[p.pos]) {
+		for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos])) {
+			p.pos++
+		}
+		return p.parseName(strings.ToLower(string(p.input[start:p.pos])))
+	}
+
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	// Exponent: 1e5, 2.5E-3
+	if p.pos > start && p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+		next := p.pos + 1
+		if next < len(p.input) && (p.input[next] == '+' || p.input[next] == '-') {
+			next++
+		}
+		if next < len(p.input) && unicode.IsDigit(p.input[next]) {
+			p.pos = next
+			for p.pos < len(p.input) && unicode.IsDigit(p.input[p.pos]) {
+				p.pos++
+			}
+		}
+	}
+	if p.pos == start {
+		if p.pos >= len(p.input) {
+			return 0, errors.New("unexpected end of the expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+
+	value, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", string(p.input[start:p.pos]))
+	}
+	return value, nil
+}
+
+// A constant or a call of a function
+func (p *expressionParser) parseName(name string) (float64, error) {
+	switch name {
+	case "pi":
+		return math.Pi, nil
+	case "e":
+		return math.E, nil
+	}
+
+	functions := map[string]func(float64) float64{
+		"sqrt": math.Sqrt, "abs": math.Abs, "exp": math.Exp, "ln": math.Log, "log10": math.Log10,
+		"sin": math.Sin, "cos": math.Cos, "tan": math.Tan, "round": math.Round, "floor": math.Floor, "ceil": math.Ceil,
+	}
+	function, ok := functions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown name %q", name)
+	}
+
+	if !p.accept('(') {
+		return 0, fmt.Errorf("%s must be followed by parentheses", name)
+	}
+	argument, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	if !p.accept(')') {
+		return 0, errors.New("missing closing parenthesis")
+	}
+	return function(argument), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		{"2 + 3 * 4", 14},
+		{"(2 + 3) * 4", 20},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"7 % 3", 1},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"(-2) ^ 2", 4},
+		{"2 ^ -1", 0.5},
+		{"-3 * -2", 6},
+		{"2 * 3 ^ 2", 18},
+		{"1.5e3 + 2.5E-1", 1500.25},
+		{"sqrt(16) + abs(-2)", 6},
+		{"round(pi * 100) / 100", 3.14},
+	}
+
+	for _, tt := range tests {
+		got, err := evaluateExpression(tt.expression)
+		if err != nil {
+			t.Errorf("evaluateExpression(%q): %v", tt.expression, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("evaluateExpression(%q) = %v, want %v", tt.expression, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateExpressionErrors(t *testing.T) {
+	for _, expression := range []string{
+		"1 / 0",
+		"5 % 0",
+		"1 / (2 - 2)",
+		"sqrt(-1)",
+		"10 ^ 1000",
+		"2 * (3 + 4",
+		"2 3",
+		"",
+		"foo(1)",
+		"sqrt 4",
+		"1 +",
+	} {
+		if got, err := evaluateExpression(expression); err == nil {
+			t.Errorf("evaluateExpression(%q) = %v, want an error", expression, got)
+		}
+	}
+}
+
+func TestSandboxPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symbolic links are not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := config.ToolsDir
+	defer func() { config.ToolsDir = saved }()
+	config.ToolsDir = root
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths that stay in the folder (".." and absolute paths are relative to its root)
+	for _, rel := range []string{"notes.txt", "sub/file.txt", "../../etc/passwd", "/etc/passwd", "sub/../../x", "inner/file.txt", "."} {
+		path, err := sandboxPath(rel)
+		if err != nil {
+			t.Errorf("sandboxPath(%q): %v", rel, err)
+			continue
+		}
+		if path != resolvedRoot && !strings.HasPrefix(path, resolvedRoot+string(filepath.Separator)) {
+			t.Errorf("sandboxPath(%q) = %q, outside %q", rel, path, resolvedRoot)
+		}
+	}
+
+	// A symbolic link to a folder outside
+	for _, rel := range []string{"escape", "escape/secret.txt"} {
+		if path, err := sandboxPath(rel); err == nil {
+			t.Errorf("sandboxPath(%q) = %q, want an error", rel, path)
+		}
+	}
+
+	config.ToolsDir = ""
+	if _, err := sandboxPath("notes.txt"); err == nil {
+		t.Error("sandboxPath without the folder: want an error")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Forum topics of supergroups. telegram-bot-api v5.5.1 does not know message_thread_id,
+// so it is read from the raw updates and added to the requests that send messages.
+
+// The number of remembered messages of the topics, the oldest ones are forgotten
+const maxTopicMessages = 10000
+
+// messageRef A message of a chat
+type messageRef struct {
+	ChatID    int64
+	MessageID int
+}
+
+// rawTopicMessage The fields of a message about its topic
+type rawTopicMessage struct {
+	MessageID int `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	MessageThreadID int              `json:"message_thread_id"`
+	IsTopicMessage  bool             `json:"is_topic_message"`
+	ReplyToMessage  *rawTopicMessage `json:"reply_to_message"`
+}
+
+// rawTopicUpdate The messages of an update that can be in a topic
+type rawTopicUpdate struct {
+	Message       *rawTopicMessage `json:"message"`
+	CallbackQuery *struct {
+		Message *rawTopicMessage `json:"message"`
+	} `json:"callback_query"`
+}
+
+var (
+	// The topics of the messages of the forums (messages outside topics are not remembered)
+	messageTopics      = make(map[messageRef]int)
+	messageTopicsOrder []messageRef
+	messageTopicsMutex sync.Mutex
+)
+
+// Decoding an update of Telegram, the topics of its messages are remembered
+func decodeUpdate(data []byte) (tgbotapi.Update, error) {
+	var update tgbotapi.Update
+	if err := json.Unmarshal(data, &update); err != nil {
+		return update, err
+	}
+
+	var raw rawTopicUpdate
+	if err := json.Unmarshal(data, &raw); err != nil {
+		logger.Debugf("Error reading the topics of the update: %v", err)
+		return update, nil
+	}
+	rememberTopics(raw.Message)
+	if raw.CallbackQuery != nil {
+		rememberTopics(raw.CallbackQuery.Message)
+	}
+	return update, nil
+}
+
+// Remembering the topic of the message and of the messages it replies to
+func rememberTopics(message *rawTopicMessage) {
+	messageTopicsMutex.Lock()
+	defer messageTopicsMutex.Unlock()
+
+	for m := message; m != nil; m = m.ReplyToMessage {
+		// In supergroups without topics message_thread_id is the reply thread, not a topic
+		if !m.IsTopicMessage || m.MessageThreadID == 0 {
+			continue
+		}
+
+		ref := messageRef{ChatID: m.Chat.ID, MessageID: m.MessageID}
+		if _, ok := messageTopics[ref]; !ok {
+			messageTopicsOrder = append(messageTopicsOrder, ref)
+		}
+		messageTopics[ref] = m.MessageThreadID
+	}
+
+	if extra := len(messageTopicsOrder) - maxTopicMessages; extra > 0 {
+		for _, ref := range messageTopicsOrder[:extra] {
+			delete(messageTopics, ref)
+		}
+		messageTopicsOrder = append([]messageRef(nil), messageTopicsOrder[extra:]...)
+	}
+}
+
+// The topic of the message (0 - the message is not in a topic)
+func messageTopic(message *tgbotapi.Message) int {
+	if message == nil || message.Chat == nil {
+		return 0
+	}
+
+	messageTopicsMutex.Lock()
+	defer messageTopicsMutex.Unlock()
+
+	return messageTopics[messageRef{ChatID: message.Chat.ID, MessageID: message.MessageID}]
+}
+
+// Request to Telegram in the chat of the conversation: new messages, documents
+// and chat actions get message_thread_id of the topic
+func requestTo(key conversationKey, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	if key.TopicID == 0 {
+		return bot.Request(c)
+	}
+
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		params, err := topicParams(c.BaseChat, key.TopicID)
+		if err != nil {
+			return nil, err
+		}
+		params.AddNonEmpty("text", c.Text)
+		params.AddBool("disable_web_page_preview", c.DisableWebPagePreview)
+		params.AddNonEmpty("parse_mode", c.ParseMode)
+		if err := params.AddInterface("entities", c.Entities); err != nil {
+			return nil, err
+		}
+		return bot.MakeRequest("sendMessage", params)
+
+	case tgbotapi.DocumentConfig:
+		params, err := topicParams(c.BaseChat, key.TopicID)
+		if err != nil {
+			return nil, err
+		}
+		params.AddNonEmpty("caption", c.Caption)
+		params.AddNonEmpty("parse_mode", c.ParseMode)
+		params.AddBool("disable_content_type_detection", c.DisableContentTypeDetection)
+		return bot.UploadFiles("sendDocument", params, []tgbotapi.RequestFile{{Name: "document", Data: c.File}})
+
+	case tgbotapi.ChatActionConfig:
+		params, err := topicParams(c.BaseChat, key.TopicID)
+		if err != nil {
+			return nil, err
+		}
+		params.AddNonEmpty("action", c.Action)
+		return bot.MakeRequest("sendChatAction", params)
+
+	default:
+		// Edits, deletions and answers to buttons refer to the message, the topic is not needed
+		return bot.Request(c)
+	}
+}
+
+// Sending a message to the chat of the conversation (to its topic, if there is one)
+func sendTo(key conversationKey, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if key.TopicID == 0 {
+		return bot.Send(c)
+	}
+
+	var message tgbotapi.Message
+	resp, err := requestTo(key, c)
+	if err != nil {
+		return message, err
+	}
+	err = json.Unmarshal(resp.Result, &message)
+	return message, err
+}
+
+// The parameters of the chat of a sent message with the topic
+func topicParams(chat tgbotapi.BaseChat, topicID int) (tgbotapi.Params, error) {
+	params := make(tgbotapi.Params)
+	if err := params.AddFirstValid("chat_id", chat.ChatID, chat.ChannelUsername); err != nil {
+		return params, err
+	}
+	params.AddNonZero("message_thread_id", topicID)
+	params.AddNonZero("reply_to_message_id", chat.ReplyToMessageID)
+	params.AddBool("disable_notification", chat.DisableNotification)
+	params.AddBool("allow_sending_without_reply", chat.AllowSendingWithoutReply)
+	err := params.AddInterface("reply_markup", chat.ReplyMarkup)
+	return params, err
+}
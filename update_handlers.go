@@ -1,23 +1,54 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	shutdownTimeout = 30 * time.Second
+)
+
+// Updates that are being processed right now (to wait for them when stopping)
+var activeUpdates sync.WaitGroup
+
 // Processing updates for the "Full" or "Stream" mode depending on the settings
 func processUpdate(update tgbotapi.Update) {
 	data, _ := json.Marshal(update)
 	logger.Debugf("Update received: %s", data)
+	if update.CallbackQuery != nil {
+		handleCallbackQuery(update.CallbackQuery)
+		return
+	}
+
 	if update.Message == nil {
 		return
 	}
 
 	chatID := update.Message.Chat.ID
+
+	// In groups the bot answers only the commands, the mentions and the replies to its messages
+	if !isAddressedToBot(update.Message) {
+		return
+	}
+
+	// The conversation of the chat or, in groups, of the topic or the reply chain; the answers are sent to it
+	key := promptConversation(update.Message)
+
+	if isGroupChat(update.Message.Chat) && !isGroupAllowed(chatID) {
+		logger.Infof("The bot is not allowed in the group %d", chatID)
+		_, _ = sendTo(key, tgbotapi.NewMessage(chatID, t("The bot is not available in this chat.")))
+		return
+	}
+
 	user := update.Message.From
 	username := user.UserName
 	if username == "" {
@@ -29,10 +60,9 @@ func processUpdate(update tgbotapi.Update) {
 		logger.Errorf("Error saving users: %v", err)
 	}
 
-	if !botUser.Allowed {
-		logger.Debugf("Access denied: ID: %d, Username: %w", user.ID, username)
-		deniedMsg := tgbotapi.NewMessage(chatID, t("Access denied."))
-		_, _ = bot.Send(deniedMsg)
+	if !hasAccess(botUser) {
+		logger.Debugf("Access denied: ID: %d, Username: %s", user.ID, username)
+		_, _ = sendTo(key, accessDeniedMessage(chatID, botUser))
 		return
 	}
 
@@ -40,64 +70,224 @@ func processUpdate(update tgbotapi.Update) {
 
 	// The command handler
 	if update.Message.IsCommand() {
-		commandHandler(update)
+		commandHandler(update, key)
 		return
 	}
 
+	// Documents and images are accepted only from the roles that may upload files
+	if (update.Message.Document != nil || len(update.Message.Photo) > 0) && !canUploadFiles(user.ID) {
+		_, _ = sendTo(key, tgbotapi.NewMessage(chatID, t("Your role does not allow sending files.")))
+		return
+	}
+
+	// A photo or an image document: the caption is the text of the message
+	image, hasImage := messageImage(update.Message)
+	if hasImage {
+		userMessage = update.Message.Caption
+	}
+
+	// Other documents are attached to the conversation as context, the caption is asked as a question.
+	// Downloading and reading the document takes time, so it is done aside from the updates.
+	if doc := update.Message.Document; doc != nil && !hasImage {
+		rememberReplyChain(key, update.Message.MessageID)
+		activeUpdates.Add(1)
+		go func() {
+			defer activeUpdates.Done()
+			if attachDocument(key, doc) {
+				promptModel(update.Message, key, update.Message.Caption, imageRef{}, false)
+			}
+		}()
+		return
+	}
+
+	promptModel(update.Message, key, userMessage, image, hasImage)
+}
+
+// Sending the message of the user to the model in turn with the other requests of the conversation
+func promptModel(message *tgbotapi.Message, key conversationKey, userMessage string, image imageRef, hasImage bool) {
+	chatID := key.ChatID
+	user := message.From
+
+	// A voice message or an audio file: the recognized text is the text of the message
+	audio, hasAudio := messageAudio(message)
+	if hasAudio && !transcriptionEnabled() {
+		_, _ = sendTo(key, tgbotapi.NewMessage(chatID, t("Voice messages are not supported.")))
+		return
+	}
+
+	// The mention only addresses the message to the bot
+	if isGroupChat(message.Chat) {
+		userMessage = withoutBotMention(userMessage)
+	}
+
+	if userMessage == "" && !hasImage && !hasAudio {
+		return
+	}
+
+	// The quotas of the user: requests per minute and tokens per day
+	if denial := admitGeneration(user.ID); denial != "" {
+		_, _ = sendTo(key, tgbotapi.NewMessage(chatID, denial))
+		return
+	}
+
+	messageID := message.MessageID
+	rememberReplyChain(key, messageID)
+
+	// Requests of the conversation are executed in turn, the number of simultaneous requests is limited
+	denial := enqueueGeneration(key, user.ID, func() {
+		if hasAudio {
+			transcript, err := transcribeAudio(audio)
+			if err != nil {
+				logger.Errorf("Error transcribing audio: %v", err)
+				_, _ = sendTo(key, tgbotapi.NewMessage(chatID, t("Failed to recognize the voice message.")))
+				return
+			}
+			if transcript == "" {
+				_, _ = sendTo(key, tgbotapi.NewMessage(chatID, t("No speech was recognized in the voice message.")))
+				return
+			}
+
+			sendTranscript(key, messageID, transcript)
+			userMessage = transcript
+		}
+
+		// The history keeps only the reference to the image, it is downloaded for the request
+		msg := LMMessage{Role: "user", Content: userMessage}
+		if hasImage {
+			msg.Images = []string{image.historyURL()}
+		}
+
+		appendMessageToConversation(key, user.ID, msg)
+		replyToPrompt(key, user.ID)
+	})
+	if denial != "" {
+		_, _ = sendTo(key, tgbotapi.NewMessage(chatID, denial))
+	}
+}
+
+// Generating the answer of the model by the current context of the conversation.
+// If messageIDs are given, the answer replaces the text of these messages (regeneration).
+// Returns the answer and the IDs of the messages with it (the buttons are under the last one).
+func generateReply(key conversationKey, userID int64, messageIDs []int, keyboard tgbotapi.InlineKeyboardMarkup) (string, []int, error) {
+	chatID := key.ChatID
+	model, ok := resolveChatModel(chatID, userID)
+	if !ok {
+		_, _ = sendTo(key, tgbotapi.NewMessage(chatID, t("No models are available to you.")))
+		return "", messageIDs, errors.New("no model is allowed to the user")
+	}
+	params := chatSamplingParams(chatID)
+
+	// The generation can be cancelled by /stop or by the "Stop" button
+	ctx, done := startGeneration(key)
+	defer done()
+
+	// Fragments of the knowledge base for the question, their sources are listed under the answer
+	knowledge := retrieveKnowledge(ctx, key)
+	conversation := buildConversationForRequest(key, model, knowledgeContext(knowledge), contextLimit(userID))
+	if err := downloadHistoryImages(conversation); err != nil {
+		logger.Errorf("Error downloading image: %v", err)
+		_, _ = sendTo(key, tgbotapi.NewMessage(chatID, t("Failed to download the image.")))
+		return "", messageIDs, err
+	}
+
 	// Depending on the operating mode of LM Studio, select the call function:
 	if config.LMStudioMode == "stream" {
-		updateConversationContextStream(chatID, "user", userMessage)
-		conversation := buildConversationForRequest(chatID)
-
 		// We send the action "prints ..."
 		typing := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
-		_, _ = bot.Send(typing)
+		_, _ = requestTo(key, typing)
+
+		renderer := newStreamRenderer(key, messageIDs, stopKeyboard())
+		response, usage, err := callLMStudioStream(ctx, model, conversation, params, renderer)
+		// The tokens of the stopped or failed generation are also counted
+		recordUsage(userID, usage.CompletionTokens)
+		stopped := isGenerationStopped(ctx, err)
+		if err != nil && !(stopped && response != "") {
+			if stopped {
+				// Nothing was generated before the stop
+				_ = renderer.Finish(t("Generation stopped."), nil)
+				return "", renderer.messageIDs, err
+			}
 
-		response, err := callLMStudioStream(selectedModel, conversation, chatID)
-		if err != nil {
 			logger.Errorf("Error calling LM Studio: %v", err)
 			errMsg := tgbotapi.NewMessage(chatID, t("Error generating response."))
-			_, _ = bot.Send(errMsg)
-			return
+			_, _ = sendTo(key, errMsg)
+			return "", renderer.messageIDs, err
 		}
-		response = convertToTelegramFormat(response)
-		updateConversationContextStream(chatID, "assistant", response)
-	} else { // "full"
-		updateConversationContext(chatID, "user", userMessage)
-		ctxMutex.Lock()
-		conversation := make([]LMMessage, len(contexts[chatID]))
-		copy(conversation, contexts[chatID])
-		ctxMutex.Unlock()
-
-		// Send a message-indicator
+		// The partial answer of the stopped generation also remains in the context (without the reasoning)
+		appendToConversation(key, userID, "assistant", stripReasoning(response))
+
+		footer := sourcesFooter(knowledge)
+		text := response
+		if stopped {
+			logger.Infof("Generation stopped in chat %d", chatID)
+			text = closeReasoning(text) + "\n\n" + t("⏹ Generation stopped.")
+		}
+
+		// The final edit with the complete answer adds the buttons under it
+		if err := renderer.Finish(text+footer, &keyboard); err != nil {
+			logger.Errorf("Error editing message: %v", err)
+		}
+
+		return response + footer, renderer.messageIDs, nil
+	}
+
+	// "full"
+	// Send a message-indicator (or show it in the regenerated message)
+	typingMsgID := 0
+	if len(messageIDs) > 0 {
+		typingMsgID = messageIDs[0]
+		edit := tgbotapi.NewEditMessageTextAndMarkup(chatID, typingMsgID, t("Bot is typing..."), stopKeyboard())
+		_, _ = bot.Request(edit)
+	} else {
 		typingMsg := tgbotapi.NewMessage(chatID, t("Bot is typing..."))
-		typingMsgID, _ := bot.Send(typingMsg)
+		typingMsg.ReplyMarkup = stopKeyboard()
+		if sent, err := sendTo(key, typingMsg); err == nil {
+			typingMsgID = sent.MessageID
+		}
+	}
 
-		response, err := callLMStudio(selectedModel, conversation)
-		if err != nil {
-			logger.Errorf("Error calling LM Studio: %v", err)
-			errMsg := tgbotapi.NewMessage(chatID, t("Error generating response."))
-			_, _ = bot.Send(errMsg)
-			return
+	response, usage, err := callLMStudio(ctx, model, conversation, params)
+	recordUsage(userID, usage.CompletionTokens)
+	if err != nil {
+		if isGenerationStopped(ctx, err) {
+			logger.Infof("Generation stopped in chat %d", chatID)
+			if typingMsgID != 0 {
+				edit := tgbotapi.NewEditMessageText(chatID, typingMsgID, t("Generation stopped."))
+				_, _ = bot.Request(edit)
+			}
+			return "", messageIDs, err
 		}
 
-		// We delete the indicator and send the answer
-		deleteTypingMsg := tgbotapi.NewDeleteMessage(chatID, typingMsgID.MessageID)
-		_, _ = bot.Send(deleteTypingMsg)
+		logger.Errorf("Error calling LM Studio: %v", err)
+		errMsg := tgbotapi.NewMessage(chatID, t("Error generating response."))
+		_, _ = sendTo(key, errMsg)
+		return "", messageIDs, err
+	}
 
-		response = convertToTelegramFormat(response)
-		updateConversationContext(chatID, "assistant", response)
-		respMsg := tgbotapi.NewMessage(chatID, response)
-		respMsg.ParseMode = tgParseMode
-		_, _ = bot.Send(respMsg)
+	appendToConversation(key, userID, "assistant", stripReasoning(response))
+	response += sourcesFooter(knowledge)
 
-		logger.Debugf("Message in telegram: %s", response)
+	// We delete the indicator of a new answer, the regenerated answer is edited in place
+	if len(messageIDs) == 0 && typingMsgID != 0 {
+		deleteTypingMsg := tgbotapi.NewDeleteMessage(chatID, typingMsgID)
+		_, _ = bot.Request(deleteTypingMsg)
 	}
+
+	// Long answers are split into several messages
+	messageIDs, err = renderReply(key, messageIDs, response, &keyboard)
+	if err != nil {
+		logger.Errorf("Error sending message: %v", err)
+		if len(messageIDs) == 0 {
+			return response, nil, err
+		}
+	}
+
+	logger.Debugf("Message in telegram: %s", response)
+	return response, messageIDs, nil
 }
 
 // HTTP Handler for Webhook
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
-	var update tgbotapi.Update
 	body, err := io.ReadAll(r.Body)
 
 	if err != nil {
@@ -106,18 +296,22 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := json.Unmarshal(body, &update); err != nil {
+	update, err := decodeUpdate(body)
+	if err != nil {
 		logger.Errorf("Error parsing update: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	activeUpdates.Add(1)
+	defer activeUpdates.Done()
+
 	processUpdate(update)
 	w.WriteHeader(http.StatusOK)
 }
 
-// Launch of Webhook server
-func startWebhookServer() {
+// Launch of Webhook server (works until stopChan is closed)
+func startWebhookServer(stopChan <-chan struct{}) {
 	domain := strings.TrimPrefix(strings.TrimPrefix(config.WebhookDomain, "http://"), "https://")
 	domain = strings.TrimLeft(domain, "/")
 
@@ -147,20 +341,32 @@ func startWebhookServer() {
 		}
 	}
 
-	http.HandleFunc("/webhook", webhookHandler)
+	// Own mux, so that the server can be started again after stopping
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", webhookHandler)
 
 	addr := fmt.Sprintf(":%s", config.WebhookPort)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-stopChan
+		logger.Info("Stop webhook server")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Errorf("Error stopping webhook server: %v", err)
+		}
+	}()
+
 	logger.Infof("Launching a webhook server on %s...", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Fatalf("HTTP server error: %v", err)
 	}
 }
 
 // Launch of Long Polling (for Polling-mode)
 func startLongPolling(stopChan <-chan struct{}) {
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = config.PollingTimeout
-	updates := bot.GetUpdatesChan(u)
+	updates := pollUpdates(stopChan)
 	logger.Infof("Long polling mode started with timeout %d sec.", config.PollingTimeout)
 	for {
 		select {
@@ -171,13 +377,109 @@ func startLongPolling(stopChan <-chan struct{}) {
 			if !ok {
 				return
 			}
-			go processUpdate(update)
+
+			activeUpdates.Add(1)
+			go func(update tgbotapi.Update) {
+				defer activeUpdates.Done()
+				processUpdate(update)
+			}(update)
 		}
 	}
 }
 
-// Command handler
-func commandHandler(update tgbotapi.Update) {
+// Receiving updates by getUpdates until stopChan is closed. The updates are decoded here
+// (not by GetUpdatesChan), so that the topics of the messages are known
+func pollUpdates(stopChan <-chan struct{}) <-chan tgbotapi.Update {
+	updates := make(chan tgbotapi.Update, 100)
+
+	go func() {
+		defer close(updates)
+
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = config.PollingTimeout
+		for {
+			select {
+			case <-stopChan:
+				return
+			default:
+			}
+
+			resp, err := bot.Request(u)
+			var raw []json.RawMessage
+			if err == nil {
+				err = json.Unmarshal(resp.Result, &raw)
+			}
+			if err != nil {
+				logger.Errorf("Failed to get updates, retrying in 3 seconds: %v", err)
+				select {
+				case <-stopChan:
+					return
+				case <-time.After(3 * time.Second):
+				}
+				continue
+			}
+
+			for _, data := range raw {
+				// The offset is moved even past an update that cannot be parsed
+				var head struct {
+					UpdateID int `json:"update_id"`
+				}
+				if err := json.Unmarshal(data, &head); err != nil || head.UpdateID < u.Offset {
+					continue
+				}
+				u.Offset = head.UpdateID + 1
+
+				update, err := decodeUpdate(data)
+				if err != nil {
+					logger.Errorf("Error parsing update: %v", err)
+					continue
+				}
+
+				select {
+				case updates <- update:
+				case <-stopChan:
+					return
+				}
+			}
+		}
+	}()
+
+	return updates
+}
+
+// Receiving updates by the method from the configuration (blocks until stopChan is closed)
+func startUpdates(stopChan <-chan struct{}) {
+	// The hosts of the backends are checked while the bot is running
+	go runHealthChecks(stopChan)
+
+	switch config.UpdateMethod {
+	case "polling":
+		startLongPolling(stopChan)
+	case "webhook":
+		startWebhookServer(stopChan)
+	default:
+		logger.Errorf("Unknown update method: %s", config.UpdateMethod)
+	}
+}
+
+// Waiting for the completion of the updates being processed, no longer than timeout
+func waitActiveUpdates(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		activeUpdates.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Command handler, the answer is sent to the conversation of the command
+func commandHandler(update tgbotapi.Update, key conversationKey) {
 	if update.Message == nil {
 		return
 	}
@@ -191,14 +493,61 @@ func commandHandler(update tgbotapi.Update) {
 		case "start":
 			msg.Text = t("Hello! I'm a Telegram bot that uses LM Studio.")
 		case "clear":
-			clearConversationContext(chatID)
+			// In groups the reply to a message clears its chain, otherwise all chains are cleared
+			if isGroupChat(update.Message.Chat) && key.TopicID == 0 && update.Message.ReplyToMessage == nil {
+				clearGroupConversations(chatID)
+			} else {
+				clearConversationContext(key)
+				forgetLastReply(key)
+				if err := clearChatDocuments(key); err != nil {
+					logger.Errorf("Error removing documents: %v", err)
+				}
+			}
 			msg.Text = t("Chat history cleared.")
+		case "model":
+			msg = modelCommand(update.Message)
+		case "allowmodels":
+			msg.Text = allowModelsCommand(update.Message)
+		case "stop":
+			// In groups the reply to a message stops its chain, otherwise all chains are stopped
+			if isGroupChat(update.Message.Chat) && key.TopicID == 0 && update.Message.ReplyToMessage == nil {
+				msg.Text = stopCommand(chatConversation(chatID))
+			} else {
+				msg.Text = stopCommand(key)
+			}
+		case "reindex":
+			msg.Text = reindexCommand(update.Message)
+		case "docs":
+			// In groups the documents belong to the conversation of the message the command replies to
+			if isGroupChat(update.Message.Chat) && key.TopicID == 0 && update.Message.ReplyToMessage == nil {
+				msg.Text = t("In groups, send /docs as a reply to a message of the conversation.")
+			} else {
+				msg = docsCommand(key)
+			}
+		case "grant":
+			msg.Text = grantCommand(update.Message)
+		case "revoke":
+			msg.Text = revokeCommand(update.Message)
+		case "settings":
+			msg.Text = settingsCommand(update.Message)
+		case "usage":
+			msg.Text = usageCommand(update.Message.From.ID)
+		case "retry":
+			// The answer is edited in place in turn with other requests of the chat
+			if msg.Text = enqueueRetry(key, update.Message.From.ID); msg.Text == "" {
+				return
+			}
 		default:
 			msg.Text = t("I don't know that command")
 		}
 
-		if _, err := bot.Send(msg); err != nil {
-			logger.Panic(err)
+		sent, err := sendTo(key, msg)
+		if err != nil {
+			// A failed answer (a too long message, a deleted topic) must not stop the bot
+			logger.Errorf("Error sending the answer to /%s: %v", update.Message.Command(), err)
+			return
 		}
+		// The buttons of the answer (the list of /docs) find the conversation by the message
+		rememberReplyChain(key, sent.MessageID)
 	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"slices"
 	"sort"
 	"sync"
 )
@@ -10,7 +11,13 @@ import (
 type BotUser struct {
 	ID       int64  `json:"id"`
 	Username string `json:"username"`
-	Allowed  bool   `json:"allowed"`
+	Role     string `json:"role"` // admin, user, guest or banned
+	// Models that the user may choose (empty - any model)
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	// The user asked for access and waits for the decision of an administrator
+	AccessRequested bool `json:"access_requested,omitempty"`
+	// Limits of the user over the limits of the role (a negative value - no limit)
+	Quota *QuotaLimits `json:"quota,omitempty"`
 }
 
 var (
@@ -28,24 +35,52 @@ func loadUsers() error {
 	if err != nil {
 		if os.IsNotExist(err) {
 			users = make(map[int64]*BotUser)
+			grantConfigAdminsLocked()
 			return nil
 		}
 		return err
 	}
 
-	var list []*BotUser
+	// The flags "allowed" and "admin" of the previous format are read to migrate them to roles
+	var list []struct {
+		BotUser
+		Allowed bool `json:"allowed"`
+		Admin   bool `json:"admin"`
+	}
 	if err := json.Unmarshal(data, &list); err != nil {
 		return err
 	}
 
 	users = make(map[int64]*BotUser)
-	for _, u := range list {
-		users[u.ID] = u
+	for _, item := range list {
+		u := item.BotUser
+		if !isValidRole(u.Role) {
+			u.Role = migrateRole(item.Admin, item.Allowed)
+			logger.Infof("The user %d got the role %s", u.ID, u.Role)
+		}
+		users[u.ID] = &u
 	}
 
+	grantConfigAdminsLocked()
 	return nil
 }
 
+// The users from "admins" of the configuration get the role "admin"
+// (without it a bot without the GUI would have no administrators)
+func grantConfigAdminsLocked() {
+	for _, id := range config.Admins {
+		u, ok := users[id]
+		if !ok {
+			u = &BotUser{ID: id}
+			users[id] = u
+		}
+		if u.Role != roleAdmin {
+			u.Role = roleAdmin
+			logger.Infof("The user %d got the role %s from the configuration", id, roleAdmin)
+		}
+	}
+}
+
 // Making users to file
 func saveUsers() error {
 	usersMutex.Lock()
@@ -77,7 +112,7 @@ func addOrUpdateUser(userID int64, username string) *BotUser {
 	newUser := &BotUser{
 		ID:       userID,
 		Username: username,
-		Allowed:  false, // By default, access is prohibited
+		Role:     roleGuest, // By default, access is prohibited
 	}
 
 	users[userID] = newUser
@@ -100,3 +135,60 @@ func getSortedUsers() []*BotUser {
 
 	return userSlice
 }
+
+// Checking whether the user may use the model
+func userCanUseModel(userID int64, model string) bool {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	u, ok := users[userID]
+	if !ok {
+		return false
+	}
+	if u.Role == roleAdmin {
+		return true
+	}
+
+	// Both the models of the role and the models of the user restrict the choice
+	roleModels := limitsForRole(u.Role).Models
+	if len(roleModels) > 0 && !slices.Contains(roleModels, model) {
+		return false
+	}
+	return len(u.AllowedModels) == 0 || slices.Contains(u.AllowedModels, model)
+}
+
+// Checking whether the user is an administrator
+func isAdmin(userID int64) bool {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	u, ok := users[userID]
+	return ok && u.Role == roleAdmin
+}
+
+// Changing the role of the user
+func setUserRole(userID int64, role string) bool {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	u, ok := users[userID]
+	if !ok {
+		return false
+	}
+	u.Role = role
+	u.AccessRequested = false
+	return true
+}
+
+// Restriction of the models available to the user (empty list removes the restriction)
+func setUserAllowedModels(userID int64, models []string) bool {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	u, ok := users[userID]
+	if !ok {
+		return false
+	}
+	u.AllowedModels = models
+	return true
+}